@@ -0,0 +1,122 @@
+// Copyright (c) 2014 Aubrey Barnard.  This is free software.  See
+// LICENSE.txt for details.
+
+// Lockstep minimization of many independent problems.
+
+package lbfgsb
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// NewBatchLbfgsb creates and returns a new BatchLbfgsb solver that uses
+// the setup of the given Lbfgsb solver.
+func NewBatchLbfgsb(lbfgsb *Lbfgsb) *BatchLbfgsb {
+	return &BatchLbfgsb{lbfgsb: lbfgsb}
+}
+
+// BatchLbfgsb minimizes many independent problems of the same
+// dimensionality together, in lockstep, so that the points that all of
+// them need evaluated can be evaluated in a single call to a batch
+// objective.  This is much faster than evaluating them one at a time
+// when the objective is vectorized.  Each problem is a Session, so each
+// has its own state and workspace, but all have the bounds and
+// parameters of the given Lbfgsb solver (as they are when minimizing).
+// The solver's logger, stop condition, checkpointing, and workspace are
+// not used.  The statistics of each problem are in its exit status,
+// and its Fortran output, if any, is written when it is done.  A
+// batch solver may be shared by concurrent minimizations as its Lbfgsb
+// solver may.
+type BatchLbfgsb struct {
+	// Solver whose setup the problems use
+	lbfgsb *Lbfgsb
+}
+
+// Minimize minimizes one problem per initial point using the L-BFGS-B
+// algorithm.  In each round, every problem that is not done is advanced
+// to its next evaluation request and then all the requested points are
+// evaluated with a single call to the objective.  Returns the minimum
+// and exit status of each problem, as for Lbfgsb.Minimize, in the same
+// order as the initial points.  If the objective returns the wrong
+// number of values or gradients, or a gradient of the wrong
+// dimensionality, the affected problems fail.  If the objective
+// panics, all the problems are closed (see Session.Close) and then
+// Minimize panics with a *CallbackPanic, as Lbfgsb.Minimize does.
+func (batch *BatchLbfgsb) Minimize(
+	objective BatchFunctionWithGradient,
+	initialPoints [][]float64) (
+		minima []PointValueGradient,
+		exitStatuses []ExitStatus) {
+
+	// Each session gets its own workspace because the problems are in
+	// progress at the same time
+	sessions := make([]*Session, len(initialPoints))
+	for i, initialPoint := range initialPoints {
+		sessions[i] = batch.lbfgsb.newSession(initialPoint, true)
+	}
+	// Release the problems if the objective panics
+	defer func() {
+		if value := recover(); value != nil {
+			callbackPanic := &CallbackPanic{Value: value, Stack: debug.Stack()}
+			for _, session := range sessions {
+				session.Close()
+			}
+			panic(callbackPanic)
+		}
+	}()
+
+	// Advance the problems in lockstep until all are done
+	pending := make([]*Session, 0, len(sessions))
+	points := make([][]float64, 0, len(sessions))
+	for {
+		// Gather the points to evaluate.  Nothing needs to be done for
+		// new iterates.
+		pending = pending[:0]
+		points = points[:0]
+		for _, session := range sessions {
+			request := session.Next()
+			for request.Kind == NEW_ITERATE {
+				request = session.Next()
+			}
+			if request.Kind == EVALUATE {
+				pending = append(pending, session)
+				points = append(points, request.X)
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+
+		// Evaluate all the points at once and distribute the results
+		values, gradients := objective.EvaluateBatch(points)
+		if len(values) != len(points) || len(gradients) != len(points) {
+			err := fmt.Errorf(
+				"Lbfgsb: Batch objective returned %d values and %d "+
+					"gradients for %d points.",
+				len(values), len(gradients), len(points))
+			for _, session := range pending {
+				session.Fail(err)
+			}
+			continue
+		}
+		for i, session := range pending {
+			if len(gradients[i]) != len(points[i]) {
+				session.Fail(fmt.Errorf(
+					"Lbfgsb: Dimensionality of the gradient (%d) does "+
+						"not match the dimensionality of the point (%d).",
+					len(gradients[i]), len(points[i])))
+				continue
+			}
+			session.Provide(values[i], gradients[i])
+		}
+	}
+
+	// Collect the results
+	minima = make([]PointValueGradient, len(sessions))
+	exitStatuses = make([]ExitStatus, len(sessions))
+	for i, session := range sessions {
+		minima[i], exitStatuses[i] = session.Result()
+	}
+	return
+}
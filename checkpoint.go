@@ -0,0 +1,332 @@
+// Copyright (c) 2014 Aubrey Barnard.  This is free software.  See
+// LICENSE.txt for details.
+
+// Checkpoint files for saving and resuming optimizations.
+
+package lbfgsb
+
+// #include "lbfgsb_go_interface.h"
+import "C"
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// Checkpoint file format.  A checkpoint is a workspace (which contains
+// the whole state of an optimization) in the following binary layout.
+// All numbers are little-endian.
+//
+//	magic           8 bytes  "LBFGSBCP"
+//	version         uint32   checkpointVersion
+//	configuration   uint64   checkpointConfiguration of the solver
+//	dimensionality  int64
+//	approx. size    int64
+//	real length     int64
+//	int length      int64
+//	char length     int64
+//	real memory     float64 * real length
+//	int memory      int32 * int length
+//	char memory     byte * char length
+//	skipped grads   int64    checkpointHistory
+//	warning count   int64
+//	warnings        (iteration int64, reason int64) * warning count
+//	restart count   int64
+//	restarts        (iteration int64, evaluations int64,
+//	                 F float64, GNorm float64) * restart count
+//	checksum        uint32   CRC-32 (IEEE) of all the preceding bytes
+//
+// The version must be incremented whenever the layout or the contents
+// of the workspace or the history change.
+const (
+	checkpointMagic   = "LBFGSBCP"
+	checkpointVersion = 1
+)
+
+// checkpointHistory is what the Go code records during an optimization
+// that is not in the workspace.  It is saved with the workspace so that
+// the statistics and warnings of a resumed optimization include those
+// before the checkpoint.
+type checkpointHistory struct {
+	// Number of evaluations whose gradient was not evaluated
+	skippedGradients int
+	warnings         []Warning
+	restarts         []RestartStatistics
+}
+
+// checkpointConfiguration returns a fingerprint (FNV-1a hash) of the
+// configuration of this solver that determines the course of an
+// optimization: the approximation size, the bounds, the tolerances,
+// and the line search parameters.  An optimization can only be resumed
+// by a solver with the same fingerprint.  (The limits and the output
+// are not included, so they can be changed when resuming.)
+func (lbfgsb *Lbfgsb) checkpointConfiguration() uint64 {
+	hash := fnv.New64a()
+	var word [8]byte
+	writeUint := func(value uint64) {
+		binary.LittleEndian.PutUint64(word[:], value)
+		hash.Write(word[:])
+	}
+	writeFloat := func(value float64) {
+		writeUint(math.Float64bits(value))
+	}
+	writeUint(uint64(lbfgsb.approximationSize))
+	for i := range lbfgsb.boundsControl_c {
+		writeUint(uint64(lbfgsb.boundsControl_c[i]))
+		writeFloat(float64(lbfgsb.lowerBounds_c[i]))
+		writeFloat(float64(lbfgsb.upperBounds_c[i]))
+	}
+	writeFloat(lbfgsb.fTolerance)
+	writeFloat(lbfgsb.gTolerance)
+	writeFloat(lbfgsb.lineSearchFTolerance)
+	writeFloat(lbfgsb.lineSearchGTolerance)
+	writeFloat(lbfgsb.lineSearchXTolerance)
+	writeFloat(lbfgsb.maxStep)
+	writeUint(uint64(lbfgsb.maxLineSearchEvaluations))
+	return hash.Sum64()
+}
+
+// writeCheckpoint saves the given workspace and history of an
+// optimization by a solver with the given configuration (see
+// checkpointConfiguration) to a checkpoint file at the given path.  Writes a temporary file and
+// then renames it so that the file at the path is always a complete
+// checkpoint.
+func writeCheckpoint(
+	path string, workspace *Workspace, history checkpointHistory,
+	configuration uint64) (err error) {
+
+	file, err := os.CreateTemp(
+		filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	// Clean up on failure
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	// Write the contents, checksumming along the way
+	checksum := crc32.NewIEEE()
+	buffer := bufio.NewWriter(io.MultiWriter(file, checksum))
+	var word [8]byte
+	write := func(data []byte) {
+		if err == nil {
+			_, err = buffer.Write(data)
+		}
+	}
+	writeUint := func(value uint64, size int) {
+		binary.LittleEndian.PutUint64(word[:], value)
+		write(word[:size])
+	}
+	write([]byte(checkpointMagic))
+	writeUint(checkpointVersion, 4)
+	writeUint(configuration, 8)
+	writeUint(uint64(workspace.dimensionality), 8)
+	writeUint(uint64(workspace.approximationSize), 8)
+	writeUint(uint64(len(workspace.realMemory)), 8)
+	writeUint(uint64(len(workspace.intMemory)), 8)
+	writeUint(uint64(len(workspace.charMemory)), 8)
+	for _, value := range workspace.realMemory {
+		writeUint(math.Float64bits(float64(value)), 8)
+	}
+	for _, value := range workspace.intMemory {
+		writeUint(uint64(uint32(value)), 4)
+	}
+	for _, value := range workspace.charMemory {
+		writeUint(uint64(uint8(value)), 1)
+	}
+	writeUint(uint64(history.skippedGradients), 8)
+	writeUint(uint64(len(history.warnings)), 8)
+	for _, warning := range history.warnings {
+		writeUint(uint64(warning.Iteration), 8)
+		writeUint(uint64(warning.Reason), 8)
+	}
+	writeUint(uint64(len(history.restarts)), 8)
+	for _, restart := range history.restarts {
+		writeUint(uint64(restart.Iteration), 8)
+		writeUint(uint64(restart.Evaluations), 8)
+		writeUint(math.Float64bits(restart.F), 8)
+		writeUint(math.Float64bits(restart.GNorm), 8)
+	}
+	if err == nil {
+		err = buffer.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(word[:], checksum.Sum32())
+	if _, err = file.Write(word[:4]); err != nil {
+		return err
+	}
+
+	// Make sure the contents are on disk before replacing the old file
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// readCheckpoint loads the workspace and history saved in the
+// checkpoint file at the given path and the configuration of the solver
+// that saved it.
+func readCheckpoint(path string) (
+		workspace *Workspace, history checkpointHistory,
+		configuration uint64, err error) {
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, history, 0, err
+	}
+
+	// Check the header and checksum before interpreting anything
+	headerSize := len(checkpointMagic) + 4 + 6*8
+	if len(contents) < headerSize+4 ||
+		string(contents[:len(checkpointMagic)]) != checkpointMagic {
+		return nil, history, 0, fmt.Errorf(
+			"Lbfgsb: %s is not a checkpoint file.", path)
+	}
+	body := contents[:len(contents)-4]
+	if crc32.ChecksumIEEE(body) !=
+		binary.LittleEndian.Uint32(contents[len(body):]) {
+		return nil, history, 0, fmt.Errorf(
+			"Lbfgsb: Checkpoint file %s is corrupt.", path)
+	}
+	reader := bytes.NewReader(body[len(checkpointMagic):])
+	var version uint32
+	var dimensionality, approximationSize int64
+	var realLength, intLength, charLength int64
+	if err := binary.Read(reader, binary.LittleEndian, &version); err != nil {
+		return nil, history, 0, fmt.Errorf(
+			"Lbfgsb: Checkpoint file %s has no version: %v", path, err)
+	}
+	if version != checkpointVersion {
+		return nil, history, 0, fmt.Errorf(
+			"Lbfgsb: Checkpoint file %s has version %d.  Expected %d.",
+			path, version, checkpointVersion)
+	}
+	err = binary.Read(reader, binary.LittleEndian, &configuration)
+	if err != nil {
+		return nil, history, 0, fmt.Errorf(
+			"Lbfgsb: Checkpoint file %s has a truncated header: %v",
+			path, err)
+	}
+	for _, value := range []*int64{&dimensionality, &approximationSize,
+		&realLength, &intLength, &charLength} {
+		err := binary.Read(reader, binary.LittleEndian, value)
+		if err != nil {
+			return nil, history, 0, fmt.Errorf(
+				"Lbfgsb: Checkpoint file %s has a truncated header: %v",
+				path, err)
+		}
+	}
+	if dimensionality <= 0 || dimensionality > math.MaxInt32 ||
+		approximationSize <= 0 || approximationSize > math.MaxInt32 ||
+		checkWorkspaceShape(
+			int(dimensionality), int(approximationSize)) != nil {
+		return nil, history, 0, fmt.Errorf(
+			"Lbfgsb: Checkpoint file %s has invalid shape "+
+				"(dimensionality %d, approximation size %d).",
+			path, dimensionality, approximationSize)
+	}
+
+	// The memory must be exactly that of a workspace of this shape
+	realSize, intSize, charSize :=
+		workspaceSize(int(dimensionality), int(approximationSize))
+	if realLength != realSize || intLength != intSize ||
+		charLength != charSize ||
+		int64(reader.Len()) < 8*realLength+4*intLength+charLength {
+		return nil, history, 0, fmt.Errorf(
+			"Lbfgsb: Checkpoint file %s has the wrong amount of "+
+				"memory for its shape.", path)
+	}
+	workspace = NewWorkspace(int(dimensionality), int(approximationSize))
+	data := body[len(body)-reader.Len():]
+	for i := range workspace.realMemory {
+		workspace.realMemory[i] = C.double(math.Float64frombits(
+			binary.LittleEndian.Uint64(data[8*i:])))
+	}
+	data = data[8*realLength:]
+	for i := range workspace.intMemory {
+		workspace.intMemory[i] = C.int(int32(
+			binary.LittleEndian.Uint32(data[4*i:])))
+	}
+	data = data[4*intLength:]
+	for i := range workspace.charMemory {
+		workspace.charMemory[i] = C.char(data[i])
+	}
+
+	// The history follows the memory and ends the file
+	history, err = readCheckpointHistory(data[charLength:])
+	if err != nil {
+		return nil, checkpointHistory{}, 0, fmt.Errorf(
+			"Lbfgsb: Checkpoint file %s has an invalid history: %v",
+			path, err)
+	}
+	return workspace, history, configuration, nil
+}
+
+// readCheckpointHistory decodes the history at the end of a checkpoint
+// (see writeCheckpoint), which must be exactly the given data.
+func readCheckpointHistory(data []byte) (
+		history checkpointHistory, err error) {
+
+	reader := bytes.NewReader(data)
+	readInt := func() (value int64) {
+		if err == nil {
+			err = binary.Read(reader, binary.LittleEndian, &value)
+		}
+		return value
+	}
+	readFloat := func() float64 {
+		return math.Float64frombits(uint64(readInt()))
+	}
+	// Check each count against the data left so that a bad count
+	// cannot allocate much
+	readCount := func(recordSize int64) int {
+		count := readInt()
+		if err == nil &&
+			(count < 0 || count > int64(reader.Len())/recordSize) {
+			err = fmt.Errorf("count %d is out of range", count)
+		}
+		if err != nil {
+			return 0
+		}
+		return int(count)
+	}
+
+	history.skippedGradients = int(readInt())
+	if history.skippedGradients < 0 {
+		return history, fmt.Errorf(
+			"skipped gradients %d < 0", history.skippedGradients)
+	}
+	history.warnings = make([]Warning, readCount(2*8))
+	for i := range history.warnings {
+		history.warnings[i].Iteration = int(readInt())
+		history.warnings[i].Reason = TerminationReason(readInt())
+	}
+	history.restarts = make([]RestartStatistics, readCount(4*8))
+	for i := range history.restarts {
+		history.restarts[i].Iteration = int(readInt())
+		history.restarts[i].Evaluations = int(readInt())
+		history.restarts[i].F = readFloat()
+		history.restarts[i].GNorm = readFloat()
+	}
+	if err == nil && reader.Len() != 0 {
+		err = fmt.Errorf("%d extra bytes", reader.Len())
+	}
+	return history, err
+}
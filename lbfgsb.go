@@ -16,9 +16,15 @@ package lbfgsb
 import "C"
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"math"
-	"reflect"
+	"runtime/cgo"
+	"runtime/debug"
+	"sync"
+	"time"
 	"unsafe"
 )
 
@@ -46,6 +52,16 @@ func NewLbfgsb(dimensionality int) *Lbfgsb {
 // zero-value Lbfgsb object is valid and needs no explicit construction.
 // A solver object will perform unconstrained optimization unless bounds
 // are set.
+//
+// Once it is set up (its dimensionality, bounds, and parameters), a
+// solver may be shared by goroutines that minimize concurrently, for
+// example a pool of workers.  Each minimization has its own state and
+// returns its own statistics (in its exit status).  Setting up a solver
+// while it is minimizing is not safe, and neither is sharing a
+// workspace (see SetWorkspace) between concurrent minimizations.  (The
+// Fortran output of each minimization is kept separate; see
+// SetFortranOutput.)  The Fortran code keeps all of its state in the
+// workspace, so it is reentrant.
 type Lbfgsb struct {
 	// Dimensionality of the problem.  Zero is an invalid
 	// dimensionality, so this also serves as an indicator of whether
@@ -54,31 +70,86 @@ type Lbfgsb struct {
 	// for computation the following must be greater than zero:
 	// dimensionality, approximationSize, fTolerance, gTolerance.
 	dimensionality int
+	// Guards initialization, which every minimization does if it has
+	// not been done, so that concurrent minimizations with a zero-value
+	// solver do not race
+	initLock sync.Mutex
 
 	// Problem specification.  Bounds may be nil or allocated fully.
 	// Individual bounds may be omitted by placing NaNs or Infs.
 	lowerBounds []float64
 	upperBounds []float64
 
+	// C copies of the bounds for passing to Fortran.  Always allocated
+	// fully (once initialized) and updated whenever the bounds change
+	// so that they are not copied for every minimization.
+	boundsControl_c []C.int
+	lowerBounds_c   []C.double
+	upperBounds_c   []C.double
+
 	// Parameters
 	approximationSize int
 	fTolerance        float64
 	gTolerance        float64
+	maxIterations     int
+	maxEvaluations    int
+	maxRestarts       int
 	printControl      int
 
+	// Line search parameters.  The flags record whether they have been
+	// set so that Init does not replace them with the defaults.
+	lineSearchFTolerance        float64
+	lineSearchGTolerance        float64
+	lineSearchXTolerance        float64
+	lineSearchTolerancesSet     bool
+	maxStep                     float64
+	maxLineSearchEvaluations    int
+	maxLineSearchEvaluationsSet bool
+
+	// Writers of the output of the Fortran code (nil for the defaults,
+	// io.Discard to suppress)
+	fortranOutput io.Writer
+	iterateFile   io.Writer
+
+	// Whether to reject (rather than project) an initial point that is
+	// outside the bounds
+	rejectInfeasible bool
+
+	// Workspace to use for minimization (may be nil)
+	workspace *Workspace
+
 	// Logging
 	logger OptimizationIterationLogger
 
-	// Statistics (do not embed or members will be public)
-	statistics OptimizationStatistics
+	// Termination
+	stopCondition OptimizationStopCondition
+
+	// Warnings
+	warningHandler OptimizationWarningHandler
+
+	// Evaluations
+	evaluationObserver OptimizationEvaluationObserver
+
+	// Checkpointing
+	checkpointPath     string
+	checkpointInterval int
+
+	// Statistics of the most recently finished minimization (do not
+	// embed or members will be public).  Guarded by the lock because
+	// minimizations may be concurrent.
+	statisticsLock sync.Mutex
+	statistics     OptimizationStatistics
 }
 
 // Init initializes this Lbfgsb solver for problems of the given
 // dimensionality.  Also sets default parameters that are not zero
 // values.  Returns this for method chaining.  Ignores calls subsequent
 // to the first (because a solver is intended for only a particular
-// dimensionality).
+// dimensionality).  Every minimization calls Init, so a zero-value
+// solver can be shared by concurrent minimizations from the start.
 func (lbfgsb *Lbfgsb) Init(dimensionality int) *Lbfgsb {
+	lbfgsb.initLock.Lock()
+	defer lbfgsb.initLock.Unlock()
 	// Only initialize if not previously initialized
 	if lbfgsb.dimensionality == 0 {
 		// Check for a valid dimensionality
@@ -97,6 +168,15 @@ func (lbfgsb *Lbfgsb) Init(dimensionality int) *Lbfgsb {
 		if lbfgsb.gTolerance == 0.0 {
 			lbfgsb.gTolerance = 1e-6
 		}
+		if !lbfgsb.lineSearchTolerancesSet {
+			lbfgsb.lineSearchFTolerance = 1e-3
+			lbfgsb.lineSearchGTolerance = 0.9
+			lbfgsb.lineSearchXTolerance = 0.1
+		}
+		if !lbfgsb.maxLineSearchEvaluationsSet {
+			lbfgsb.maxLineSearchEvaluations = 20
+		}
+		lbfgsb.makeCBounds()
 	}
 	return lbfgsb
 }
@@ -104,6 +184,12 @@ func (lbfgsb *Lbfgsb) Init(dimensionality int) *Lbfgsb {
 // SetBounds sets the upper and lower bounds on the individual
 // dimensions to the given intervals resulting in a constrained
 // optimization problem.  Individual bounds may be (+/-)Inf.
+//
+// In all the bounds setting methods, a lower bound that is NaN or -Inf
+// and an upper bound that is NaN or +Inf mean that side is unbounded.
+// Bounds are validated when minimizing: a lower bound of +Inf, an upper
+// bound of -Inf, or a lower bound greater than its upper bound make the
+// problem infeasible and result in a 'USAGE_ERROR'.
 func (lbfgsb *Lbfgsb) SetBounds(bounds [][2]float64) *Lbfgsb {
 	// Ensure object is initialized
 	lbfgsb.Init(len(bounds))
@@ -118,6 +204,7 @@ func (lbfgsb *Lbfgsb) SetBounds(bounds [][2]float64) *Lbfgsb {
 		lbfgsb.lowerBounds[i] = interval[0]
 		lbfgsb.upperBounds[i] = interval[1]
 	}
+	lbfgsb.makeCBounds()
 	return lbfgsb
 }
 
@@ -135,6 +222,7 @@ func (lbfgsb *Lbfgsb) SetBoundsAll(lower, upper float64) *Lbfgsb {
 		lbfgsb.lowerBounds[i] = lower
 		lbfgsb.upperBounds[i] = upper
 	}
+	lbfgsb.makeCBounds()
 	return lbfgsb
 }
 
@@ -182,6 +270,7 @@ func (lbfgsb *Lbfgsb) SetBoundsSparse(sparseBounds map[int][]float64) *Lbfgsb {
 			lbfgsb.upperBounds[i] = pInf
 		}
 	}
+	lbfgsb.makeCBounds()
 	return lbfgsb
 }
 
@@ -190,9 +279,197 @@ func (lbfgsb *Lbfgsb) SetBoundsSparse(sparseBounds map[int][]float64) *Lbfgsb {
 func (lbfgsb *Lbfgsb) ClearBounds() *Lbfgsb {
 	lbfgsb.lowerBounds = nil
 	lbfgsb.upperBounds = nil
+	lbfgsb.makeCBounds()
 	return lbfgsb
 }
 
+// makeCBounds makes the C copies of the bounds and the bounds control
+// that are passed to Fortran.  They must be different slices than the
+// Go bounds because those must remain unallocated if no bounds are
+// specified.  Does nothing until the dimensionality is known.
+func (lbfgsb *Lbfgsb) makeCBounds() {
+	dim := lbfgsb.dimensionality
+	if dim == 0 {
+		return
+	}
+
+	// Set up bounds control
+	lbfgsb.boundsControl_c = make([]C.int, dim)
+	if lbfgsb.lowerBounds != nil {
+		for index, bound := range lbfgsb.lowerBounds {
+			if hasLowerBound(bound) {
+				lbfgsb.boundsControl_c[index] = C.int(1)
+			}
+		}
+	}
+	if lbfgsb.upperBounds != nil {
+		for index, bound := range lbfgsb.upperBounds {
+			if hasUpperBound(bound) {
+				// Map 0 -> 3, 1 -> 2
+				lbfgsb.boundsControl_c[index] =
+					C.int(3 - lbfgsb.boundsControl_c[index])
+			}
+		}
+	}
+
+	// Set up lower and upper bounds
+	lbfgsb.lowerBounds_c = makeCCopySlice_Float(lbfgsb.lowerBounds, dim)
+	lbfgsb.upperBounds_c = makeCCopySlice_Float(lbfgsb.upperBounds, dim)
+}
+
+// hasLowerBound returns whether the given value is a lower bound, that
+// is, whether it is not NaN or -Inf.
+func hasLowerBound(bound float64) bool {
+	return !math.IsNaN(bound) && !math.IsInf(bound, -1)
+}
+
+// hasUpperBound returns whether the given value is an upper bound, that
+// is, whether it is not NaN or +Inf.
+func hasUpperBound(bound float64) bool {
+	return !math.IsNaN(bound) && !math.IsInf(bound, +1)
+}
+
+// checkBounds checks that the bounds describe a feasible region.
+// Returns an error describing the first infeasible interval, if any.
+func (lbfgsb *Lbfgsb) checkBounds() error {
+	// No bounds are always feasible
+	if lbfgsb.lowerBounds == nil {
+		return nil
+	}
+	for i := 0; i < lbfgsb.dimensionality; i++ {
+		lower, upper := lbfgsb.lowerBounds[i], lbfgsb.upperBounds[i]
+		if math.IsInf(lower, +1) {
+			return fmt.Errorf("Lbfgsb: Lower bound of variable %d is +Inf.  Expected < +Inf.", i)
+		}
+		if math.IsInf(upper, -1) {
+			return fmt.Errorf("Lbfgsb: Upper bound of variable %d is -Inf.  Expected > -Inf.", i)
+		}
+		if hasLowerBound(lower) && hasUpperBound(upper) && lower > upper {
+			return fmt.Errorf("Lbfgsb: Lower bound of variable %d (%g) > upper bound (%g).  Expected lower <= upper.", i, lower, upper)
+		}
+	}
+	return nil
+}
+
+// projectPoint returns the projection of the given point into the
+// bounds and the indices of the coordinates that had to be clamped to a
+// bound.  If no coordinates were clamped, returns the given point
+// itself (and nil indices).  The bounds must be feasible.
+func (lbfgsb *Lbfgsb) projectPoint(point []float64) (
+	projected []float64, clamped []int) {
+
+	projected = point
+	// No bounds means nothing to project
+	if lbfgsb.lowerBounds == nil {
+		return
+	}
+	for i, x := range point {
+		lower, upper := lbfgsb.lowerBounds[i], lbfgsb.upperBounds[i]
+		clampedX := x
+		if hasLowerBound(lower) && x < lower {
+			clampedX = lower
+		} else if hasUpperBound(upper) && x > upper {
+			clampedX = upper
+		}
+		if clampedX != x {
+			// Copy the point on the first change
+			if clamped == nil {
+				projected = make([]float64, len(point))
+				copy(projected, point)
+			}
+			projected[i] = clampedX
+			clamped = append(clamped, i)
+		}
+	}
+	return
+}
+
+// activeSetTracker finds the changes in the active set (the variables
+// at a bound) from iterate to iterate.  Uses the C copies of the bounds
+// so that it sees the same bounds as the Fortran code.
+type activeSetTracker struct {
+	boundsControl_c []C.int
+	lowerBounds_c   []C.double
+	upperBounds_c   []C.double
+	// Bound each variable was at in the previous point, nil if not
+	// known
+	bounds []Bound
+}
+
+// newActiveSetTracker creates a tracker for the bounds of this solver
+// starting from the given point.  The point may be nil if it is not
+// known (as when resuming), in which case the changes for the first
+// iterate are not known either.
+func (lbfgsb *Lbfgsb) newActiveSetTracker(
+	initialPoint []float64) *activeSetTracker {
+
+	tracker := &activeSetTracker{
+		boundsControl_c: lbfgsb.boundsControl_c,
+		lowerBounds_c:   lbfgsb.lowerBounds_c,
+		upperBounds_c:   lbfgsb.upperBounds_c,
+	}
+	if initialPoint != nil {
+		tracker.bounds = tracker.activeBounds(initialPoint)
+	}
+	return tracker
+}
+
+// activeBounds returns the bound each coordinate of the given point is
+// at.  A fixed variable (equal bounds) is at its lower bound.
+func (tracker *activeSetTracker) activeBounds(point []float64) []Bound {
+	bounds := make([]Bound, len(point))
+	for i, x := range point {
+		// Bounds control: 0 none, 1 lower, 2 both, 3 upper
+		control := tracker.boundsControl_c[i]
+		if (control == 1 || control == 2) &&
+			x == float64(tracker.lowerBounds_c[i]) {
+			bounds[i] = LOWER_BOUND
+		} else if (control == 2 || control == 3) &&
+			x == float64(tracker.upperBounds_c[i]) {
+			bounds[i] = UPPER_BOUND
+		}
+	}
+	return bounds
+}
+
+// size returns the number of variables of the given point that are at
+// a bound.
+func (tracker *activeSetTracker) size(point []float64) (size int) {
+	for _, bound := range tracker.activeBounds(point) {
+		if bound != NO_BOUND {
+			size++
+		}
+	}
+	return
+}
+
+// update returns the changes in the active set from the previous point
+// to the given one (nil if the previous point is not known) and then
+// remembers the given point as the previous one.
+func (tracker *activeSetTracker) update(
+	point []float64) (changes []ActiveSetChange) {
+
+	bounds := tracker.activeBounds(point)
+	if tracker.bounds != nil {
+		for i, bound := range bounds {
+			previous := tracker.bounds[i]
+			if bound == previous {
+				continue
+			}
+			if previous != NO_BOUND {
+				changes = append(changes, ActiveSetChange{
+					Index: i, Bound: previous, Entering: false})
+			}
+			if bound != NO_BOUND {
+				changes = append(changes, ActiveSetChange{
+					Index: i, Bound: bound, Entering: true})
+			}
+		}
+	}
+	tracker.bounds = bounds
+	return
+}
+
 // SetApproximationSize sets the amount of history (points and
 // gradients) stored and used to approximate the inverse Hessian matrix.
 // More history allows better approximation at the cost of more memory.
@@ -225,6 +502,117 @@ func (lbfgsb *Lbfgsb) SetGTolerance(gTolerance float64) *Lbfgsb {
 	return lbfgsb
 }
 
+// SetMaxIterations sets the maximum number of iterations to perform.
+// If the limit is reached before convergence, optimization stops with
+// a 'WARNING' exit status and the result is the current iterate.
+// Defaults to 0, no limit.
+func (lbfgsb *Lbfgsb) SetMaxIterations(maxIterations int) *Lbfgsb {
+	if maxIterations < 0 {
+		panic(fmt.Errorf("Lbfgsb: Max iterations %d < 0.  Expected >= 0.", maxIterations))
+	}
+	lbfgsb.maxIterations = maxIterations
+	return lbfgsb
+}
+
+// SetMaxEvaluations sets the maximum number of evaluations (each
+// evaluation is one function call and one gradient call) to perform.
+// The limit is checked before each evaluation, so it holds even in the
+// middle of a line search.  If the limit is reached before
+// convergence, optimization stops with a 'WARNING' exit status and the
+// result is the current iterate or, if it is better, the best point
+// evaluated.  Defaults to 0, no limit.
+func (lbfgsb *Lbfgsb) SetMaxEvaluations(maxEvaluations int) *Lbfgsb {
+	if maxEvaluations < 0 {
+		panic(fmt.Errorf("Lbfgsb: Max evaluations %d < 0.  Expected >= 0.", maxEvaluations))
+	}
+	lbfgsb.maxEvaluations = maxEvaluations
+	return lbfgsb
+}
+
+// SetRestartPolicy sets the maximum number of times to restart the
+// optimization when its line search fails ('ABNORMAL_LINE_SEARCH').
+// L-BFGS-B only gives up on a line search after it has already cleared
+// its limited memory and retried along the steepest-descent direction
+// with a unit first step (the full step to the generalized Cauchy
+// point).  A restart starts L-BFGS-B over from the current iterate, not
+// from the initial point, which evaluates the iterate again and makes
+// the first step of the next line search have length 1 (at most 1 if
+// there are bounds), as in the first iteration.  So a restart only
+// changes the length of the first trial step, which helps when the
+// full step was far too long or too short.  It is only done if the
+// objective has decreased since the start (or the previous restart) and
+// if not every variable has both bounds (for such problems the first
+// step is a unit step anyway); otherwise the optimization stops as it
+// would without restarts.  Each restart is reported as a warning (see
+// Warning) and counted in the statistics.  The iterations and
+// evaluations of all the restarts count toward the limits.  Defaults
+// to 0, no restarts.
+func (lbfgsb *Lbfgsb) SetRestartPolicy(maxRestarts int) *Lbfgsb {
+	if maxRestarts < 0 {
+		panic(fmt.Errorf("Lbfgsb: Max restarts %d < 0.  Expected >= 0.", maxRestarts))
+	}
+	lbfgsb.maxRestarts = maxRestarts
+	return lbfgsb
+}
+
+// SetLineSearchTolerances sets the tolerances of the Moré-Thuente line
+// search.  The step it finds satisfies the strong Wolfe conditions:
+// fTolerance is the tolerance of the sufficient decrease condition and
+// gTolerance is the tolerance of the curvature condition.  A smaller
+// gTolerance makes the line search more exact (and more expensive).
+// xTolerance is the relative width of the interval of uncertainty at
+// which the line search gives up with a warning.  Tolerances must
+// satisfy 0 < fTolerance < gTolerance < 1 and xTolerance >= 0.
+// Defaults to 1e-3, 0.9, and 0.1.
+func (lbfgsb *Lbfgsb) SetLineSearchTolerances(
+	fTolerance, gTolerance, xTolerance float64) *Lbfgsb {
+
+	if !(0 < fTolerance && fTolerance < gTolerance && gTolerance < 1) {
+		panic(fmt.Errorf("Lbfgsb: Line search F tolerance %g and G "+
+			"tolerance %g.  Expected 0 < F tolerance < G tolerance < 1.",
+			fTolerance, gTolerance))
+	}
+	if !(xTolerance >= 0) {
+		panic(fmt.Errorf("Lbfgsb: Line search X tolerance %g < 0.  "+
+			"Expected >= 0.", xTolerance))
+	}
+	lbfgsb.lineSearchFTolerance = fTolerance
+	lbfgsb.lineSearchGTolerance = gTolerance
+	lbfgsb.lineSearchXTolerance = xTolerance
+	lbfgsb.lineSearchTolerancesSet = true
+	return lbfgsb
+}
+
+// SetMaxStep sets the maximum length (Euclidean norm) of any step
+// taken by the line search.  This includes the first step, which
+// otherwise has length 1 and may be far too long for a badly scaled
+// problem.  The maximum must not be negative or NaN.  Defaults to 0,
+// no limit.
+func (lbfgsb *Lbfgsb) SetMaxStep(maxStep float64) *Lbfgsb {
+	if !(maxStep >= 0) {
+		panic(fmt.Errorf("Lbfgsb: Max step %g < 0.  Expected >= 0.", maxStep))
+	}
+	lbfgsb.maxStep = maxStep
+	return lbfgsb
+}
+
+// SetMaxLineSearchEvaluations sets the maximum number of evaluations
+// in a single line search.  A line search that needs more fails, which
+// ends the optimization with 'ABNORMAL_LINE_SEARCH' unless L-BFGS-B
+// can start over with a fresh memory (see also SetRestartPolicy).
+// Defaults to 20.
+func (lbfgsb *Lbfgsb) SetMaxLineSearchEvaluations(
+	maxEvaluations int) *Lbfgsb {
+
+	if maxEvaluations <= 0 {
+		panic(fmt.Errorf("Lbfgsb: Max line search evaluations %d <= 0.  "+
+			"Expected > 0.", maxEvaluations))
+	}
+	lbfgsb.maxLineSearchEvaluations = maxEvaluations
+	lbfgsb.maxLineSearchEvaluationsSet = true
+	return lbfgsb
+}
+
 // SetFortranPrintControl sets the level of output verbosity from the
 // Fortran L-BFGS-B code.  Defaults to 0, no output.  Ranges from 0 to
 // 102: 1 displays a summary, 100 displays details of each iteration,
@@ -237,6 +625,50 @@ func (lbfgsb *Lbfgsb) SetFortranPrintControl(verbosity int) *Lbfgsb {
 	return lbfgsb
 }
 
+// SetFortranOutput sets where the output of the Fortran L-BFGS-B code
+// (see SetFortranPrintControl) goes.  The output of each minimization
+// is collected and then written to the writer in one piece when the
+// minimization finishes, so the output of concurrent minimizations
+// does not interleave.  Output beyond 1 MiB is spilled to a temporary
+// file until then, so a long minimization does not keep all of it in
+// memory.  It is collected through a pipe on Linux and macOS and
+// through a temporary file elsewhere.  Nothing is collected when the
+// print control is 0.  Errors writing are ignored.  May be nil, which
+// suppresses the output.  Defaults to standard output.
+func (lbfgsb *Lbfgsb) SetFortranOutput(w io.Writer) *Lbfgsb {
+	if w == nil {
+		w = io.Discard
+	}
+	lbfgsb.fortranOutput = w
+	return lbfgsb
+}
+
+// SetIterateFile sets where the summary of the iterations that the
+// Fortran L-BFGS-B code writes when the print control is at least 2
+// goes.  It is collected and written like the output (see
+// SetFortranOutput).  May be nil, which suppresses the summary.
+// Defaults to the file 'iterate.dat' in the current directory, which
+// is written like any other writer when the minimization finishes (it
+// is replaced by a new minimization and appended to by a resumed one),
+// so concurrent minimizations do not open it together.  Errors writing
+// it are ignored.
+func (lbfgsb *Lbfgsb) SetIterateFile(w io.Writer) *Lbfgsb {
+	if w == nil {
+		w = io.Discard
+	}
+	lbfgsb.iterateFile = w
+	return lbfgsb
+}
+
+// SetProjectInitialPoint sets whether to project an initial point that
+// is outside the bounds into the bounds (true) or to reject it with a
+// 'USAGE_ERROR' (false).  The indices of any projected (clamped)
+// coordinates are reported in the statistics.  Defaults to true.
+func (lbfgsb *Lbfgsb) SetProjectInitialPoint(project bool) *Lbfgsb {
+	lbfgsb.rejectInfeasible = !project
+	return lbfgsb
+}
+
 // SetLogger sets a logging function for the optimization that will be
 // called after each iteration.  May be nil, which disables logging.
 // Defaults to nil.
@@ -247,59 +679,390 @@ func (lbfgsb *Lbfgsb) SetLogger(
 	return lbfgsb
 }
 
+// SetStopCondition sets a function that decides whether to stop the
+// optimization early.  It is called after each iteration (after the
+// logger, if any) with information about the iteration.  If it returns
+// true, optimization stops with a 'WARNING' exit status whose message
+// is the given reason and the result is the current iterate.  May be
+// nil, which disables the check.  Defaults to nil.
+func (lbfgsb *Lbfgsb) SetStopCondition(
+	stopCondition OptimizationStopCondition) *Lbfgsb {
+
+	lbfgsb.stopCondition = stopCondition
+	return lbfgsb
+}
+
+// SetWarningHandler sets a function that is told about each warning
+// (see Warning) during the optimization as it happens.  Warnings are
+// also listed in the exit status whether or not there is a handler.
+// May be nil, which disables the handler.  Defaults to nil.
+func (lbfgsb *Lbfgsb) SetWarningHandler(
+	warningHandler OptimizationWarningHandler) *Lbfgsb {
+
+	lbfgsb.warningHandler = warningHandler
+	return lbfgsb
+}
+
+// SetEvaluationObserver sets a function that is told about each
+// evaluation of the objective (see EvaluationInfo), including the trial
+// points of line searches, which the logger does not see.  May be nil,
+// which disables the observer.  Defaults to nil.
+func (lbfgsb *Lbfgsb) SetEvaluationObserver(
+	evaluationObserver OptimizationEvaluationObserver) *Lbfgsb {
+
+	lbfgsb.evaluationObserver = evaluationObserver
+	return lbfgsb
+}
+
+// SetCheckpoint sets the file to which the state of the optimization
+// is saved every so many iterations so that an interrupted
+// optimization (for example, because of a crash or preemption) can be
+// continued with Resume.  The file is replaced atomically, so it always
+// contains a complete checkpoint.  An empty path disables
+// checkpointing.  Defaults to disabled.
+func (lbfgsb *Lbfgsb) SetCheckpoint(
+	path string, everyNIterations int) *Lbfgsb {
+
+	if path != "" && everyNIterations <= 0 {
+		panic(fmt.Errorf("Lbfgsb: Checkpoint interval %d <= 0.  Expected > 0.", everyNIterations))
+	}
+	lbfgsb.checkpointPath = path
+	lbfgsb.checkpointInterval = everyNIterations
+	return lbfgsb
+}
+
+// SetWorkspace sets the workspace (memory) to use for minimization.
+// The shape of the workspace (its dimensionality and approximation
+// size) must match this solver when minimizing.  A workspace can be
+// reused for any number of minimizations, but only one at a time.  May
+// be nil, in which case each minimization allocates its own workspace.
+// Defaults to nil.
+func (lbfgsb *Lbfgsb) SetWorkspace(workspace *Workspace) *Lbfgsb {
+	lbfgsb.workspace = workspace
+	return lbfgsb
+}
+
+// NewWorkspace allocates and returns a new workspace whose shape
+// matches this solver's dimensionality and approximation size.  Init
+// must be called first to set the dimensionality.
+func (lbfgsb *Lbfgsb) NewWorkspace() *Workspace {
+	// Check object has been initialized
+	if lbfgsb.dimensionality == 0 {
+		panic(fmt.Errorf("Lbfgsb: Init() must be called before NewWorkspace()."))
+	}
+	return NewWorkspace(lbfgsb.dimensionality, lbfgsb.approximationSize)
+}
+
 // Minimize optimizes the given objective using the L-BFGS-B algorithm.
 // Implements OptimizationFunctionMinimizer.Minimize.
+//
+// Upon convergence, the minimum is the final iterate.  Otherwise (for
+// example, if a limit is reached, the line search fails, the objective
+// fails, or the optimization is stopped early) progress is not thrown
+// away: the minimum is the most recent iterate unless a point with a
+// lower, finite objective value was evaluated, in which case it is that
+// point and exitStatus.Fallback is true.  If no point with a finite
+// value and gradient was evaluated, the minimum is the initial point
+// with NaN value and gradient.  The same holds for all the variants of
+// Minimize.
+//
+// If the objective is not finite (NaN or Inf) at a trial point of a
+// line search, or an objective that can fail returns ErrOutsideDomain,
+// the line search tries a shorter step from the previous iterate
+// instead of failing.  It gives up after as many evaluations as it
+// would otherwise.  These recoveries are counted in the statistics.  If
+// the objective is not finite at the initial point, there is nothing to
+// go back to, so the exit status is a 'USAGE_ERROR'.
+//
+// Statistics about the minimization are in exitStatus.Statistics().  They
+// are also available from OptimizationStatistics until the next
+// minimization finishes.
+//
+// Line search warnings and restarts (see Warning) do not stop the
+// minimization.  They are listed in exitStatus.Warnings() and passed to
+// the warning handler, if any.
+//
+// If the objective, logger, stop condition, warning handler, or
+// evaluation observer panics, the panic is recovered before it can
+// unwind through the Fortran code, the optimization is stopped, and
+// then Minimize panics with a *CallbackPanic containing the original
+// panic value and stack trace.
+// The same holds for all the variants of Minimize.
 func (lbfgsb *Lbfgsb) Minimize(
 	objective FunctionWithGradient,
 	initialPoint []float64) (
 		minimum PointValueGradient,
 		exitStatus ExitStatus) {
 
-	// Make sure object has been initialized
-	lbfgsb.Init(len(initialPoint))
+	return lbfgsb.MinimizeContext(
+		context.Background(), objective, initialPoint)
+}
 
-	// Check dimensionality
+// MinimizeErr is like Minimize but for objectives that can fail.  If
+// evaluating the objective returns an error, optimization stops with a
+// 'FAILURE' exit status that wraps the error (so that it can be
+// retrieved with errors.Unwrap, errors.Is, or errors.As).  The minimum
+// is the best point found before the failure (see Minimize).
+func (lbfgsb *Lbfgsb) MinimizeErr(
+	objective FunctionWithGradientErr,
+	initialPoint []float64) (
+		minimum PointValueGradient,
+		exitStatus ExitStatus) {
+
+	return lbfgsb.MinimizeErrContext(
+		context.Background(), objective, initialPoint)
+}
+
+// MinimizeContext optimizes the given objective using the L-BFGS-B
+// algorithm, stopping early if the given context is cancelled or its
+// deadline passes.  The context is checked before each evaluation of
+// the objective.  If the optimization stops because of the context,
+// the result is the best point found so far and the exit status is
+// 'CANCELED' and wraps the context's error (so that, for example,
+// 'errors.Is(exitStatus, context.Canceled)' is true).  Implements
+// ObjectiveFunctionMinimizerContext.MinimizeContext.
+func (lbfgsb *Lbfgsb) MinimizeContext(
+	ctx context.Context,
+	objective FunctionWithGradient,
+	initialPoint []float64) (
+		minimum PointValueGradient,
+		exitStatus ExitStatus) {
+
+	return lbfgsb.MinimizeErrContext(ctx, infallible(objective), initialPoint)
+}
+
+// MinimizeErrContext combines MinimizeErr and MinimizeContext: it
+// optimizes an objective that can fail and stops early if the given
+// context is done.
+//
+// All the variants of Minimize detect objectives that can evaluate
+// value and gradient together (CombinedFunctionWithGradient and
+// CombinedFunctionWithGradientErr) and then use only the combined
+// evaluation.
+func (lbfgsb *Lbfgsb) MinimizeErrContext(
+	ctx context.Context,
+	objective FunctionWithGradientErr,
+	initialPoint []float64) (
+		minimum PointValueGradient,
+		exitStatus ExitStatus) {
+
+	minimum, _, exitStatus = lbfgsb.minimize(
+		ctx, objective, initialPoint, minimizeOptions{})
+	return
+}
+
+// MinimizeFrom is like Minimize but starts with the given
+// approximation of the Hessian (a warm start), for example the final
+// approximation from a previous optimization of a similar problem,
+// instead of with an empty one.  The approximation may be nil for a
+// cold start.  If it has more correction pairs than the approximation
+// size, only the newest are used.  If it is not positive definite, it
+// is ignored.  Returns the final approximation along with the minimum
+// so that it can be passed to the next optimization.
+//
+// Because the approximation already contains curvature information,
+// the first line search tries a full step, as in later iterations.
+func (lbfgsb *Lbfgsb) MinimizeFrom(
+	approximation *HessianApproximation,
+	objective FunctionWithGradient,
+	initialPoint []float64) (
+		minimum PointValueGradient,
+		finalApproximation *HessianApproximation,
+		exitStatus ExitStatus) {
+
+	return lbfgsb.MinimizeFromErrContext(context.Background(),
+		approximation, infallible(objective), initialPoint)
+}
+
+// MinimizeFromErrContext combines MinimizeFrom and MinimizeErrContext.
+func (lbfgsb *Lbfgsb) MinimizeFromErrContext(
+	ctx context.Context,
+	approximation *HessianApproximation,
+	objective FunctionWithGradientErr,
+	initialPoint []float64) (
+		minimum PointValueGradient,
+		finalApproximation *HessianApproximation,
+		exitStatus ExitStatus) {
+
+	return lbfgsb.minimize(ctx, objective, initialPoint,
+		minimizeOptions{
+			approximation:       approximation,
+			returnApproximation: true,
+		})
+}
+
+// Resume continues the optimization whose state was saved in the given
+// checkpoint file (see SetCheckpoint), typically by a process that was
+// interrupted.  The objective should be the same as for the original
+// optimization, and so must the configuration of this solver that
+// determines the course of the optimization (its approximation size,
+// bounds, tolerances, and line search parameters), or the result is a
+// 'USAGE_ERROR'.  The limits, the output, and the callbacks may differ.
+// The dimensionality is taken from the checkpoint if this solver has
+// not been initialized.  Continues to checkpoint if checkpointing is
+// enabled.  Counts of iterations and evaluations, warnings, restarts,
+// and the L-BFGS-B timers include those before the checkpoint.
+func (lbfgsb *Lbfgsb) Resume(
+	path string,
+	objective FunctionWithGradient) (
+		minimum PointValueGradient,
+		exitStatus ExitStatus) {
+
+	return lbfgsb.ResumeErrContext(
+		context.Background(), path, infallible(objective))
+}
+
+// ResumeErrContext combines Resume and MinimizeErrContext.
+func (lbfgsb *Lbfgsb) ResumeErrContext(
+	ctx context.Context,
+	path string,
+	objective FunctionWithGradientErr) (
+		minimum PointValueGradient,
+		exitStatus ExitStatus) {
+
+	workspace, history, configuration, err := readCheckpoint(path)
+	if err == nil {
+		lbfgsb.Init(workspace.dimensionality)
+		if configuration != lbfgsb.checkpointConfiguration() {
+			err = fmt.Errorf(
+				"Lbfgsb: Checkpoint file %s was saved by a solver with "+
+					"different bounds, tolerances, or parameters.", path)
+		}
+	}
+	if err != nil {
+		exitStatus.Code = USAGE_ERROR
+		exitStatus.Reason = INVALID_INPUT
+		exitStatus.Message = err.Error()
+		exitStatus.mutableDetails().cause = err
+		return
+	}
+	// The point is in the workspace, so only its dimensionality matters
+	minimum, _, exitStatus = lbfgsb.minimize(ctx, objective,
+		make([]float64, workspace.dimensionality),
+		minimizeOptions{resume: workspace, history: history})
+	return
+}
+
+// minimizeOptions are the options that distinguish the variants of
+// Minimize.
+type minimizeOptions struct {
+	// Initial approximation for a warm start (may be nil)
+	approximation *HessianApproximation
+	// Whether to return the final approximation
+	returnApproximation bool
+	// Workspace containing the state of an optimization to resume (may
+	// be nil) and the history of the optimization up to then
+	resume  *Workspace
+	history checkpointHistory
+}
+
+// minimize implements all the variants of Minimize.
+func (lbfgsb *Lbfgsb) minimize(
+	ctx context.Context,
+	objective FunctionWithGradientErr,
+	initialPoint []float64,
+	options minimizeOptions) (
+		minimum PointValueGradient,
+		finalApproximation *HessianApproximation,
+		exitStatus ExitStatus) {
+
+	// Time the whole minimization
+	start := time.Now()
+
+	// Check the problem and choose the workspace
 	dim := len(initialPoint)
 	dim_c := C.int(dim)
-	if lbfgsb.dimensionality != dim {
+	initialPoint, clamped, workspace, err := lbfgsb.prepare(
+		initialPoint, options.resume, false)
+	if err != nil {
 		exitStatus.Code = USAGE_ERROR
-		exitStatus.Message = fmt.Sprintf("Lbfgsb: Dimensionality of the initial point (%d) does not match the dimensionality of the solver (%d).", dim, lbfgsb.dimensionality)
+		exitStatus.Reason = INVALID_INPUT
+		exitStatus.Message = err.Error()
 		return
 	}
 
-	// Set up bounds control.  Use a C-compatible type.
-	boundsControl := make([]C.int, dim)
-	if lbfgsb.lowerBounds != nil {
-		for index, bound := range lbfgsb.lowerBounds {
-			if !math.IsNaN(bound) && !math.IsInf(bound, -1) {
-				boundsControl[index] = C.int(1)
-			}
+	// Lay out the initial approximation, if any, for C.  Use only the
+	// newest correction pairs if there are too many.
+	var initialS, initialY []float64
+	var initialMemorySize int
+	initialTheta := 1.0
+	if approximation := options.approximation; approximation != nil {
+		if err := approximation.check(dim); err != nil {
+			exitStatus.Code = USAGE_ERROR
+			exitStatus.Reason = INVALID_INPUT
+			exitStatus.Message = err.Error()
+			return
 		}
-	}
-	if lbfgsb.upperBounds != nil {
-		for index, bound := range lbfgsb.upperBounds {
-			if !math.IsNaN(bound) && !math.IsInf(bound, -1) {
-				// Map 0 -> 3, 1 -> 2
-				boundsControl[index] = C.int(3 - boundsControl[index])
-			}
+		first := 0
+		if len(approximation.S) > lbfgsb.approximationSize {
+			first = len(approximation.S) - lbfgsb.approximationSize
+		}
+		for i := first; i < len(approximation.S); i++ {
+			initialS = append(initialS, approximation.S[i]...)
+			initialY = append(initialY, approximation.Y[i]...)
 		}
+		initialMemorySize = len(approximation.S) - first
+		initialTheta = approximation.Theta
 	}
 
-	// Set up lower and upper bounds.  These must be different slices
-	// than the ones in the Lbfgsb object because those must remain
-	// unallocated if no bounds are specified.
-	lowerBounds := makeCCopySlice_Float(lbfgsb.lowerBounds, dim)
-	upperBounds := makeCCopySlice_Float(lbfgsb.upperBounds, dim)
-
-	// Set up callbacks for function, gradient, and logging
-	callbackData_c := unsafe.Pointer(
-		&callbackData{objective: objective})
-	var doLogging_c C.int                        // false
-	var logFunctionCallbackData_c unsafe.Pointer // null
-	if lbfgsb.logger != nil {
+	// Open the Fortran output for this minimization
+	output, err := lbfgsb.openFortranOutput(options.resume != nil)
+	if err != nil {
+		exitStatus.Code = FAILURE
+		exitStatus.Message = fmt.Sprintf("Error: Fortran output failed: %v", err)
+		exitStatus.mutableDetails().cause = err
+		return
+	}
+	defer output.close()
+
+	// Set up callbacks for function, gradient, and logging.  All the
+	// callbacks share the same data so that they can record panics in
+	// the same place.
+	cbData := &callbackData{
+		ctx:            ctx,
+		objective:      objective,
+		logger:         lbfgsb.logger,
+		stopCondition:  lbfgsb.stopCondition,
+		warningHandler: lbfgsb.warningHandler,
+		workspace:      workspace,
+		checkpointPath: lbfgsb.checkpointPath,
+
+		evaluationObserver: lbfgsb.evaluationObserver,
+	}
+	if cbData.checkpointPath != "" {
+		cbData.checkpointConfiguration = lbfgsb.checkpointConfiguration()
+	}
+	// Continue the history of a resumed optimization (empty otherwise)
+	cbData.skippedGradients = options.history.skippedGradients
+	cbData.iterationSkippedGradients = options.history.skippedGradients
+	cbData.warnings = append([]Warning(nil), options.history.warnings...)
+	cbData.restarts = append(
+		[]RestartStatistics(nil), options.history.restarts...)
+	// The initial point is in the workspace when resuming
+	if options.resume != nil {
+		cbData.activeSet = lbfgsb.newActiveSetTracker(nil)
+	} else {
+		cbData.activeSet = lbfgsb.newActiveSetTracker(initialPoint)
+	}
+	if combined, ok := objective.(CombinedFunctionWithGradientErr); ok {
+		cbData.combinedObjective = combined
+	}
+	// Pass the callback data to C as a handle because it contains Go
+	// pointers
+	callbackHandle := cgo.NewHandle(cbData)
+	defer callbackHandle.Delete()
+	callbackHandle_c := C.uintptr_t(callbackHandle)
+	var combinedObjective_c C.int // false
+	if cbData.combinedObjective != nil {
+		combinedObjective_c = C.int(1) // true
+	}
+	var doLogging_c C.int // false
+	if lbfgsb.logger != nil || lbfgsb.stopCondition != nil {
 		doLogging_c = C.int(1) // true
-		logFunctionCallbackData_c = unsafe.Pointer(
-			&logCallbackData{logger: lbfgsb.logger})
+	}
+	var observeEvaluations_c C.int // false
+	if lbfgsb.evaluationObserver != nil {
+		observeEvaluations_c = C.int(1) // true
 	}
 
 	// Allocate arrays for return value
@@ -310,7 +1073,19 @@ func (lbfgsb *Lbfgsb) Minimize(
 	approximationSize_c := C.int(lbfgsb.approximationSize)
 	fTolerance_c := C.double(lbfgsb.fTolerance)
 	gTolerance_c := C.double(lbfgsb.gTolerance)
+	maxIterations_c := C.int(lbfgsb.maxIterations)
+	maxEvaluations_c := C.int(lbfgsb.maxEvaluations)
+	maxRestarts_c := C.int(lbfgsb.maxRestarts)
+	lineSearchFTolerance_c := C.double(lbfgsb.lineSearchFTolerance)
+	lineSearchGTolerance_c := C.double(lbfgsb.lineSearchGTolerance)
+	lineSearchXTolerance_c := C.double(lbfgsb.lineSearchXTolerance)
+	maxStep_c := C.double(lbfgsb.maxStep)
+	maxLineSearchEvaluations_c := C.int(lbfgsb.maxLineSearchEvaluations)
 	printControl_c := C.int(lbfgsb.printControl)
+	var checkpointInterval_c C.int // disabled
+	if lbfgsb.checkpointPath != "" {
+		checkpointInterval_c = C.int(lbfgsb.checkpointInterval)
+	}
 
 	// Prepare buffers and arrays for C.  Avoid allocation in C land by
 	// allocating compatible things in Go and passing their addresses.
@@ -318,14 +1093,43 @@ func (lbfgsb *Lbfgsb) Minimize(
 	// is how they did it on the Cgo page: http://golang.org/cmd/cgo/.
 	// (One could always allocate slices of C types, pass those, and
 	// then copy out and convert the contents on return.)
-	var boundsControl_c *C.int = &boundsControl[0]
-	var lowerBounds_c *C.double = &lowerBounds[0]
-	var upperBounds_c *C.double = &upperBounds[0]
+	var boundsControl_c *C.int = &lbfgsb.boundsControl_c[0]
+	var lowerBounds_c *C.double = &lbfgsb.lowerBounds_c[0]
+	var upperBounds_c *C.double = &lbfgsb.upperBounds_c[0]
 	var x0_c *C.double = (*C.double)(&initialPoint[0])
+	var realWorkspace_c *C.double = &workspace.realMemory[0]
+	var intWorkspace_c *C.int = &workspace.intMemory[0]
+	var charWorkspace_c *C.char = &workspace.charMemory[0]
+	var resume_c C.int // false
+	if options.resume != nil {
+		resume_c = C.int(1) // true
+	}
 	var minX_c *C.double = (*C.double)(&minimum.X[0])
 	var minF_c *C.double = (*C.double)(&minimum.F)
 	var minG_c *C.double = (*C.double)(&minimum.G[0])
-	var iters_c, evals_c C.int
+	var minFallback_c, iters_c, evals_c, recoveries_c, reason_c C.int
+	// Statistics
+	var skippedUpdates_c C.int
+	var minGNorm_c, cauchyTime_c, subspaceTime_c, lineSearchTime_c C.double
+	// Warm start
+	initialMemorySize_c := C.int(initialMemorySize)
+	initialTheta_c := C.double(initialTheta)
+	var initialS_c, initialY_c *C.double // null
+	if initialMemorySize > 0 {
+		initialS_c = (*C.double)(&initialS[0])
+		initialY_c = (*C.double)(&initialY[0])
+	}
+	// Final approximation
+	var finalS, finalY []float64
+	var finalS_c, finalY_c *C.double // null
+	var finalMemorySize_c C.int
+	var finalTheta_c C.double
+	if options.returnApproximation {
+		finalS = make([]float64, dim*lbfgsb.approximationSize)
+		finalY = make([]float64, dim*lbfgsb.approximationSize)
+		finalS_c = (*C.double)(&finalS[0])
+		finalY_c = (*C.double)(&finalY[0])
+	}
 	// Status message
 	statusMessageLength_c := C.int(bufferSize)
 	var statusMessageBuffer [bufferSize]C.char
@@ -333,30 +1137,154 @@ func (lbfgsb *Lbfgsb) Minimize(
 
 	// Call the actual L-BFGS-B procedure
 	statusCode_c := C.lbfgsb_minimize_c(
-		callbackData_c, dim_c,
+		callbackHandle_c, combinedObjective_c, dim_c,
 		boundsControl_c, lowerBounds_c, upperBounds_c,
 		approximationSize_c, fTolerance_c, gTolerance_c,
-		x0_c, minX_c, minF_c, minG_c, &iters_c, &evals_c,
-		printControl_c, doLogging_c, logFunctionCallbackData_c,
+		maxIterations_c, maxEvaluations_c, maxRestarts_c,
+		lineSearchFTolerance_c, lineSearchGTolerance_c,
+		lineSearchXTolerance_c, maxStep_c, maxLineSearchEvaluations_c,
+		x0_c, initialMemorySize_c, initialS_c, initialY_c, initialTheta_c,
+		realWorkspace_c, intWorkspace_c, charWorkspace_c, resume_c,
+		minX_c, minF_c, minG_c, &minFallback_c,
+		&iters_c, &evals_c, &recoveries_c, &reason_c,
+		&minGNorm_c, &skippedUpdates_c,
+		&cauchyTime_c, &subspaceTime_c, &lineSearchTime_c,
+		&finalMemorySize_c, finalS_c, finalY_c, &finalTheta_c,
+		printControl_c, output.outputUnit_c, output.iterateUnit_c,
+		doLogging_c, observeEvaluations_c,
+		checkpointInterval_c,
 		statusMessage_c, statusMessageLength_c,
 	)
 
+	// Re-raise any panic from a callback now that C/Fortran is no
+	// longer on the stack
+	if cbData.panic != nil {
+		panic(cbData.panic)
+	}
+
 	// Convert outputs
 	// Exit status codes match between ExitStatusCode and the C enum
 	exitStatus.Code = ExitStatusCode(statusCode_c)
+	// The C code knows a cancellation only as a callback stopping the
+	// optimization early
+	if exitStatus.Code == WARNING && cbData.cause != nil &&
+		cbData.cause == cbData.ctx.Err() {
+		exitStatus.Code = CANCELED
+	}
+	// Termination reasons match between TerminationReason and the C
+	// enum
+	exitStatus.Reason = TerminationReason(reason_c)
 	exitStatus.Message = C.GoString(statusMessage_c)
+	exitStatus.Fallback = minFallback_c != 0
+	exitStatus.mutableDetails().warnings = cbData.warnings
+	// Attach the reason for stopping early or failing, if any
+	exitStatus.mutableDetails().cause = cbData.cause
 	// Minimum already populated because pointers to its members were
 	// passed into C/Fortran
+	if options.returnApproximation {
+		// Slice the correction pairs out of the C layout
+		pairs := int(finalMemorySize_c)
+		finalApproximation = &HessianApproximation{
+			S:     make([][]float64, pairs),
+			Y:     make([][]float64, pairs),
+			Theta: float64(finalTheta_c),
+		}
+		for i := 0; i < pairs; i++ {
+			finalApproximation.S[i] = finalS[i*dim : (i+1)*dim : (i+1)*dim]
+			finalApproximation.Y[i] = finalY[i*dim : (i+1)*dim : (i+1)*dim]
+		}
+	}
 
 	// Save statistics
-	lbfgsb.statistics.Iterations = int(iters_c)
-	lbfgsb.statistics.FunctionEvaluations = int(evals_c)
-	// Number of function and gradient evaluations is always the same
-	lbfgsb.statistics.GradientEvaluations = lbfgsb.statistics.FunctionEvaluations
+	statistics := &exitStatus.mutableDetails().statistics
+	statistics.ClampedCoordinates = clamped
+	statistics.Iterations = int(iters_c)
+	statistics.FunctionEvaluations = int(evals_c)
+	// The gradient is evaluated along with the function except where
+	// the value is not finite
+	statistics.GradientEvaluations = int(evals_c) - cbData.skippedGradients
+	statistics.DomainRecoveries = int(recoveries_c)
+	statistics.Restarts = len(cbData.restarts)
+	statistics.RestartHistory = cbData.restarts
+	statistics.SkippedUpdates = int(skippedUpdates_c)
+	statistics.FinalGNorm = float64(minGNorm_c)
+	statistics.FinalActiveVariables = cbData.activeSet.size(minimum.X)
+	statistics.CauchyTime = secondsToDuration(float64(cauchyTime_c))
+	statistics.SubspaceTime = secondsToDuration(float64(subspaceTime_c))
+	statistics.LineSearchTime =
+		secondsToDuration(float64(lineSearchTime_c))
+	statistics.WallTime = time.Since(start)
+	statistics.CallbackTime = cbData.callbackTime
+	statistics.SolverTime = statistics.WallTime - statistics.CallbackTime
+	lbfgsb.saveStatistics(*statistics)
 
 	return
 }
 
+// prepare checks the given initial point and the setup of this solver
+// before involving C/Fortran.  Returns the feasible initial point, the
+// indices of any coordinates that had to be clamped to make it
+// feasible, and the workspace to use: the given one to resume from,
+// the solver's (unless a workspace of its own is needed), or a new
+// one.  Returns an error if the problem cannot be optimized as
+// specified.
+func (lbfgsb *Lbfgsb) prepare(
+	initialPoint []float64,
+	resume *Workspace,
+	ownWorkspace bool) (
+		projectedPoint []float64,
+		clamped []int,
+		workspace *Workspace,
+		err error) {
+
+	// Make sure object has been initialized
+	lbfgsb.Init(len(initialPoint))
+
+	// Check dimensionality
+	dim := len(initialPoint)
+	if lbfgsb.dimensionality != dim {
+		err = fmt.Errorf("Lbfgsb: Dimensionality of the initial point (%d) does not match the dimensionality of the solver (%d).", dim, lbfgsb.dimensionality)
+		return
+	}
+
+	// Validate the bounds
+	if err = lbfgsb.checkBounds(); err != nil {
+		return
+	}
+
+	// Make sure the initial point is feasible (there is no initial
+	// point when resuming)
+	if resume == nil {
+		projectedPoint, clamped = lbfgsb.projectPoint(initialPoint)
+	} else {
+		projectedPoint = initialPoint
+	}
+	if clamped != nil && lbfgsb.rejectInfeasible {
+		i := clamped[0]
+		err = fmt.Errorf("Lbfgsb: Initial point coordinate %d (%g) is outside its bounds [%g, %g].", i, initialPoint[i], lbfgsb.lowerBounds[i], lbfgsb.upperBounds[i])
+		return
+	}
+
+	// Use the workspace to resume from, the given workspace, or a new
+	// one
+	workspace = resume
+	if workspace == nil && !ownWorkspace {
+		workspace = lbfgsb.workspace
+	}
+	if workspace == nil {
+		err = checkWorkspaceShape(dim, lbfgsb.approximationSize)
+		if err != nil {
+			return
+		}
+		workspace = NewWorkspace(dim, lbfgsb.approximationSize)
+	} else if workspace.dimensionality != dim ||
+		workspace.approximationSize != lbfgsb.approximationSize {
+		err = fmt.Errorf("Lbfgsb: Shape of the workspace (dimensionality %d, approximation size %d) does not match the shape of the solver (dimensionality %d, approximation size %d).", workspace.dimensionality, workspace.approximationSize, dim, lbfgsb.approximationSize)
+		return
+	}
+	return
+}
+
 // makeCCopySlice_Float creates a C copy of a Go slice.  If the Go slice
 // is nil, then a slice of the given length is created.
 func makeCCopySlice_Float(slice []float64, sliceLen int) (
@@ -372,26 +1300,277 @@ func makeCCopySlice_Float(slice []float64, sliceLen int) (
 	return
 }
 
-// OptimizationStatistics returns some statistics about the most recent
-// minimization: the total number of iterations and the total numbers of
-// function and gradient evaluations.
+// Workspace is the memory that the L-BFGS-B algorithm works in for an
+// optimization problem of a particular dimensionality and
+// approximation size.  The memory is allocated (on the heap) by Go
+// rather than by Fortran (on the stack), so a workspace works for
+// problems with very many variables and can be reused across
+// minimizations to avoid reallocating it.  A workspace may only be used
+// by one minimization at a time.
+type Workspace struct {
+	dimensionality    int
+	approximationSize int
+
+	// Memory passed to Fortran.  Sizes are determined by the library.
+	realMemory []C.double
+	intMemory  []C.int
+	charMemory []C.char
+}
+
+// NewWorkspace allocates and returns a new workspace for problems of
+// the given dimensionality and approximation size (see
+// Lbfgsb.SetApproximationSize).  The Fortran code indexes the workspace
+// with C ints, so the shape must not need more than math.MaxInt32
+// elements of memory (about 2 * dimensionality * approximation size).
+func NewWorkspace(dimensionality, approximationSize int) *Workspace {
+	if dimensionality <= 0 {
+		panic(fmt.Errorf("Lbfgsb: Workspace dimensionality %d <= 0.  Expected > 0.", dimensionality))
+	}
+	if approximationSize <= 0 {
+		panic(fmt.Errorf("Lbfgsb: Workspace approximation size %d <= 0.  Expected > 0.", approximationSize))
+	}
+	if err := checkWorkspaceShape(dimensionality, approximationSize); err != nil {
+		panic(err)
+	}
+
+	realSize, intSize, charSize :=
+		workspaceSize(dimensionality, approximationSize)
+	return &Workspace{
+		dimensionality:    dimensionality,
+		approximationSize: approximationSize,
+		realMemory:        make([]C.double, realSize),
+		intMemory:         make([]C.int, intSize),
+		charMemory:        make([]C.char, charSize),
+	}
+}
+
+// workspaceSize returns the lengths of the memory arrays of a workspace
+// of the given positive dimensionality and approximation size, each of
+// which must fit in a C int.  Asks the library, which computes the
+// lengths in 64 bits, so they may be too large for a C int to index
+// (see checkWorkspaceShape).
+func workspaceSize(dimensionality, approximationSize int) (
+		realSize, intSize, charSize int64) {
+
+	var realSize_c, intSize_c, charSize_c C.int64_t
+	C.lbfgsb_workspace_size(
+		C.int(dimensionality), C.int(approximationSize),
+		&realSize_c, &intSize_c, &charSize_c)
+	return int64(realSize_c), int64(intSize_c), int64(charSize_c)
+}
+
+// checkWorkspaceShape returns an error if a workspace of the given
+// (positive) dimensionality and approximation size would need more
+// memory than a C int can index.
+func checkWorkspaceShape(dimensionality, approximationSize int) error {
+	tooLarge := dimensionality > math.MaxInt32 ||
+		approximationSize > math.MaxInt32
+	if !tooLarge {
+		realSize, intSize, charSize :=
+			workspaceSize(dimensionality, approximationSize)
+		tooLarge = realSize > math.MaxInt32 || intSize > math.MaxInt32 ||
+			charSize > math.MaxInt32
+	}
+	if tooLarge {
+		return fmt.Errorf("Lbfgsb: Workspace for dimensionality %d and "+
+			"approximation size %d needs more than %d elements.  "+
+			"Expected a smaller problem or approximation size.",
+			dimensionality, approximationSize, math.MaxInt32)
+	}
+	return nil
+}
+
+// Dimensionality returns the dimensionality of the problems this
+// workspace is for.
+func (ws *Workspace) Dimensionality() int {
+	return ws.dimensionality
+}
+
+// ApproximationSize returns the approximation size of the problems this
+// workspace is for.
+func (ws *Workspace) ApproximationSize() int {
+	return ws.approximationSize
+}
+
+// OptimizationStatistics returns some statistics about the most
+// recently finished minimization: the total number of iterations and
+// the total numbers of function and gradient evaluations.  When
+// minimizations are concurrent, use the statistics in the exit status
+// of each instead.
 func (lbfgsb *Lbfgsb) OptimizationStatistics() OptimizationStatistics {
+	lbfgsb.statisticsLock.Lock()
+	defer lbfgsb.statisticsLock.Unlock()
 	return lbfgsb.statistics
 }
 
-// callbackData is a container for the actual objective function and
-// related data.
-type callbackData struct {
-	objective FunctionWithGradient
+// saveStatistics records the given statistics as those of the most
+// recently finished minimization.
+func (lbfgsb *Lbfgsb) saveStatistics(statistics OptimizationStatistics) {
+	lbfgsb.statisticsLock.Lock()
+	defer lbfgsb.statisticsLock.Unlock()
+	lbfgsb.statistics = statistics
+}
+
+// HessianApproximation is the limited-memory approximation of the
+// Hessian that L-BFGS-B builds during an optimization: the most recent
+// correction pairs, s = x[k+1] - x[k] and y = g[k+1] - g[k], and the
+// scaling factor, theta, of the initial approximation (theta * I).  It
+// can be carried from one optimization to the next with MinimizeFrom
+// so that a similar problem starts with curvature information.
+type HessianApproximation struct {
+	// Correction pairs, oldest first.  Each vector has the
+	// dimensionality of the problem.
+	S [][]float64
+	Y [][]float64
+	// Scaling factor, > 0
+	Theta float64
 }
 
-// logCallbackData is a container for the logging function.  It might be
-// tempting to just use a function pointer instead of this container,
+// check returns an error if this approximation is malformed or does
+// not match the given dimensionality.
+func (ha *HessianApproximation) check(dim int) error {
+	if len(ha.S) != len(ha.Y) {
+		return fmt.Errorf("Lbfgsb: Number of S vectors (%d) does not match number of Y vectors (%d) of the Hessian approximation.", len(ha.S), len(ha.Y))
+	}
+	for i := range ha.S {
+		if len(ha.S[i]) != dim || len(ha.Y[i]) != dim {
+			return fmt.Errorf("Lbfgsb: Dimensionality of correction pair %d (%d, %d) of the Hessian approximation does not match the dimensionality of the solver (%d).", i, len(ha.S[i]), len(ha.Y[i]), dim)
+		}
+	}
+	if len(ha.S) > 0 && !(ha.Theta > 0 && !math.IsInf(ha.Theta, 1)) {
+		return fmt.Errorf("Lbfgsb: Theta of the Hessian approximation (%g) is not positive and finite.", ha.Theta)
+	}
+	return nil
+}
+
+// callbackData is a container for the actual objective function,
+// logging and stop condition functions, and related data.  It might be
+// tempting to just use function pointers instead of this container,
 // but passing a function pointer to void* in C possibly truncates the
 // address because void* is for data pointers only and function pointers
 // may be wider.
-type logCallbackData struct {
-	logger OptimizationIterationLogger
+type callbackData struct {
+	ctx       context.Context
+	objective FunctionWithGradientErr
+	// The objective if it can evaluate value and gradient together,
+	// otherwise nil
+	combinedObjective CombinedFunctionWithGradientErr
+	logger            OptimizationIterationLogger
+	stopCondition     OptimizationStopCondition
+	warningHandler    OptimizationWarningHandler
+	// Observer of evaluations and the time spent evaluating the
+	// objective since the previous evaluation was observed
+	evaluationObserver OptimizationEvaluationObserver
+	evaluationTime     time.Duration
+	// Time spent in the callbacks, number of evaluations whose
+	// gradient was not evaluated, and that number as of the previous
+	// iteration, for statistics
+	callbackTime              time.Duration
+	skippedGradients          int
+	iterationSkippedGradients int
+	// Warnings and restarts so far
+	warnings []Warning
+	restarts []RestartStatistics
+	// Active set of the previous iterate
+	activeSet *activeSetTracker
+	// Workspace of the optimization, file to save it to for
+	// checkpoints, and configuration of the solver to save with it
+	workspace               *Workspace
+	checkpointPath          string
+	checkpointConfiguration uint64
+	// Error explaining why the callbacks stopped the optimization
+	// early or failed, if they did
+	cause error
+	// Panic recovered from a callback, if any
+	panic *CallbackPanic
+}
+
+// timeCallback adds the time since the given start of a callback to the
+// time spent in the callbacks.  Must be deferred by the callback.
+func (cbData *callbackData) timeCallback(start time.Time) {
+	cbData.callbackTime += time.Since(start)
+}
+
+// recoverPanic recovers from a panic in a callback so that the panic
+// does not unwind through C/Fortran, which is undefined behavior.
+// Records the panic so it can be re-raised once the optimization has
+// returned to Go and tells C/Fortran to stop by setting the status.
+// Must be deferred directly by the callback.
+func (cbData *callbackData) recoverPanic(
+	statusCode_c *C.int,
+	statusMessage_c *C.char, statusMessageLength_c C.int) {
+
+	if value := recover(); value != nil {
+		cbData.panic = &CallbackPanic{Value: value, Stack: debug.Stack()}
+		copyGoStringToC(fmt.Sprintf("Error: Panic in callback: %v", value),
+			statusMessage_c, statusMessageLength_c)
+		*statusCode_c = C.int(FAILURE)
+	}
+}
+
+// CallbackPanic is the value with which Minimize (and its variants)
+// panics when a callback (the objective, logger, stop condition,
+// warning handler, or evaluation observer) panics.  The panic is
+// recovered in the callback, the optimization is stopped, and then the
+// panic is re-raised in Go with this value, which contains the original
+// panic value and the stack trace of where the panic occurred.
+type CallbackPanic struct {
+	Value interface{}
+	Stack []byte
+}
+
+// Error allows this CallbackPanic to be treated like an error object.
+func (cp *CallbackPanic) Error() string {
+	return fmt.Sprintf("Lbfgsb: Panic in callback: %v\n\n%s", cp.Value, cp.Stack)
+}
+
+// Unwrap returns the original panic value if it is an error, otherwise
+// nil.
+func (cp *CallbackPanic) Unwrap() error {
+	err, _ := cp.Value.(error)
+	return err
+}
+
+// infallible adapts the given objective so that it can be used as one
+// that returns errors, preserving whether it can evaluate value and
+// gradient together.
+func infallible(objective FunctionWithGradient) FunctionWithGradientErr {
+	if combined, ok := objective.(CombinedFunctionWithGradient); ok {
+		return infallibleCombinedObjective{combined}
+	}
+	return infallibleObjective{objective}
+}
+
+// infallibleObjective adapts a FunctionWithGradient to a
+// FunctionWithGradientErr that never returns errors.
+type infallibleObjective struct {
+	objective FunctionWithGradient
+}
+
+func (io infallibleObjective) EvaluateFunction(point []float64) (float64, error) {
+	return io.objective.EvaluateFunction(point), nil
+}
+
+func (io infallibleObjective) EvaluateGradient(point []float64) ([]float64, error) {
+	return io.objective.EvaluateGradient(point), nil
+}
+
+// infallibleCombinedObjective adapts a CombinedFunctionWithGradient to
+// a CombinedFunctionWithGradientErr that never returns errors.
+type infallibleCombinedObjective struct {
+	objective CombinedFunctionWithGradient
+}
+
+func (ico infallibleCombinedObjective) EvaluateFunction(point []float64) (float64, error) {
+	return ico.objective.EvaluateFunction(point), nil
+}
+
+func (ico infallibleCombinedObjective) EvaluateGradient(point []float64) ([]float64, error) {
+	return ico.objective.EvaluateGradient(point), nil
+}
+
+func (ico infallibleCombinedObjective) EvaluateFunctionGradient(point, gradient []float64) (float64, error) {
+	return ico.objective.EvaluateFunctionGradient(point, gradient), nil
 }
 
 // go_objective_function_callback is an adapter between the C callback
@@ -402,7 +1581,7 @@ type logCallbackData struct {
 //export go_objective_function_callback
 func go_objective_function_callback(
 	dim_c C.int, point_c, value_c *C.double,
-	callbackData_c unsafe.Pointer,
+	callbackData_c C.uintptr_t,
 	statusMessage_c *C.char, statusMessageLength_c C.int) (
 		statusCode_c C.int) {
 
@@ -410,18 +1589,48 @@ func go_objective_function_callback(
 
 	// Convert inputs
 	dim := int(dim_c)
-	wrapCArrayAsGoSlice_Float64(point_c, dim, &point)
-	cbData := (*callbackData)(callbackData_c)
+	point = wrapCArrayAsGoSlice_Float64(point_c, dim)
+	cbData := callbackDataFromC(callbackData_c)
+	defer cbData.timeCallback(time.Now())
+	defer cbData.recoverPanic(
+		&statusCode_c, statusMessage_c, statusMessageLength_c)
+
+	// Stop (without error) if the context is done.  Each evaluation
+	// starts with the function, so checking here checks between
+	// evaluations.
+	if err := cbData.ctx.Err(); err != nil {
+		cbData.cause = err
+		copyGoStringToC(fmt.Sprintf("Stopped: %v", err),
+			statusMessage_c, statusMessageLength_c)
+		statusCode_c = C.int(WARNING)
+		return
+	}
 
-	// Evaluate the objective function.  Let panics propagate through
-	// C/Fortran.
-	value := cbData.objective.EvaluateFunction(point)
+	// Evaluate the objective function.  A point outside the domain is
+	// not an error, just a value that is not finite.
+	start := time.Now()
+	value, err := cbData.objective.EvaluateFunction(point)
+	cbData.evaluationTime += time.Since(start)
+	if errors.Is(err, ErrOutsideDomain) {
+		value, err = math.NaN(), nil
+	}
+	if err != nil {
+		cbData.cause = err
+		copyGoStringToC(
+			fmt.Sprintf("Error: Objective function failed: %v", err),
+			statusMessage_c, statusMessageLength_c)
+		statusCode_c = C.int(FAILURE)
+		return
+	}
+	// The Fortran code does not evaluate the gradient where the value
+	// is not finite
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		cbData.skippedGradients++
+	}
 
 	// Convert outputs
 	*value_c = C.double(value)
 
-	//fmt.Printf("go_objective_function_callback: %v; %v;\n", point, value)
-
 	return
 }
 
@@ -433,7 +1642,7 @@ func go_objective_function_callback(
 //export go_objective_gradient_callback
 func go_objective_gradient_callback(
 	dim_c C.int, point_c, gradient_c *C.double,
-	callbackData_c unsafe.Pointer,
+	callbackData_c C.uintptr_t,
 	statusMessage_c *C.char, statusMessageLength_c C.int) (
 		statusCode_c C.int) {
 
@@ -441,18 +1650,94 @@ func go_objective_gradient_callback(
 
 	// Convert inputs
 	dim := int(dim_c)
-	wrapCArrayAsGoSlice_Float64(point_c, dim, &point)
-	cbData := (*callbackData)(callbackData_c)
-
-	// Evaluate the gradient of the objective function.  Let panics
-	// propagate through C/Fortran.
-	gradRet = cbData.objective.EvaluateGradient(point)
+	point = wrapCArrayAsGoSlice_Float64(point_c, dim)
+	cbData := callbackDataFromC(callbackData_c)
+	defer cbData.timeCallback(time.Now())
+	defer cbData.recoverPanic(
+		&statusCode_c, statusMessage_c, statusMessageLength_c)
+
+	// Evaluate the gradient of the objective function
+	start := time.Now()
+	gradRet, err := cbData.objective.EvaluateGradient(point)
+	cbData.evaluationTime += time.Since(start)
+	if errors.Is(err, ErrOutsideDomain) {
+		gradRet, err = nanSlice(dim), nil
+	}
+	if err == nil && len(gradRet) != dim {
+		err = fmt.Errorf(
+			"Lbfgsb: Dimensionality of the gradient (%d) does not "+
+				"match the dimensionality of the point (%d).",
+			len(gradRet), dim)
+	}
+	if err != nil {
+		cbData.cause = err
+		copyGoStringToC(
+			fmt.Sprintf("Error: Objective gradient failed: %v", err),
+			statusMessage_c, statusMessageLength_c)
+		statusCode_c = C.int(FAILURE)
+		return
+	}
 
 	// Convert outputs
-	wrapCArrayAsGoSlice_Float64(gradient_c, dim, &gradient)
+	gradient = wrapCArrayAsGoSlice_Float64(gradient_c, dim)
 	copy(gradient, gradRet)
 
-	//fmt.Printf("go_objective_gradient_callback: %v; %v;\n", point, gradient)
+	return
+}
+
+// go_objective_function_gradient_callback is an adapter between the C
+// callback and the Go callback for evaluating the objective function
+// and gradient together.  The Go callback writes the gradient directly
+// into the Fortran array, so there is no allocation or copying.
+// Exported to C for use as a function pointer.  Must match the
+// signature of objective_function_gradient_type in lbfgsb_c.h.
+//
+//export go_objective_function_gradient_callback
+func go_objective_function_gradient_callback(
+	dim_c C.int, point_c, value_c, gradient_c *C.double,
+	callbackData_c C.uintptr_t,
+	statusMessage_c *C.char, statusMessageLength_c C.int) (
+		statusCode_c C.int) {
+
+	var point, gradient []float64
+
+	// Convert inputs
+	dim := int(dim_c)
+	point = wrapCArrayAsGoSlice_Float64(point_c, dim)
+	gradient = wrapCArrayAsGoSlice_Float64(gradient_c, dim)
+	cbData := callbackDataFromC(callbackData_c)
+	defer cbData.timeCallback(time.Now())
+	defer cbData.recoverPanic(
+		&statusCode_c, statusMessage_c, statusMessageLength_c)
+
+	// Stop (without error) if the context is done
+	if err := cbData.ctx.Err(); err != nil {
+		cbData.cause = err
+		copyGoStringToC(fmt.Sprintf("Stopped: %v", err),
+			statusMessage_c, statusMessageLength_c)
+		statusCode_c = C.int(WARNING)
+		return
+	}
+
+	// Evaluate the objective function and gradient
+	start := time.Now()
+	value, err := cbData.combinedObjective.EvaluateFunctionGradient(
+		point, gradient)
+	cbData.evaluationTime += time.Since(start)
+	if errors.Is(err, ErrOutsideDomain) {
+		value, err = math.NaN(), nil
+	}
+	if err != nil {
+		cbData.cause = err
+		copyGoStringToC(
+			fmt.Sprintf("Error: Objective function failed: %v", err),
+			statusMessage_c, statusMessageLength_c)
+		statusCode_c = C.int(FAILURE)
+		return
+	}
+
+	// Convert outputs
+	*value_c = C.double(value)
 
 	return
 }
@@ -464,53 +1749,240 @@ func go_objective_gradient_callback(
 //
 //export go_log_function_callback
 func go_log_function_callback(
-	logCallbackData_c unsafe.Pointer,
+	callbackData_c C.uintptr_t,
 	iteration_c, fgEvals_c, fgEvalsTotal_c C.int, stepLength_c C.double,
 	dim_c C.int, x_c *C.double, f_c C.double, g_c *C.double,
-	fDelta_c, fDeltaBound_c, gNorm_c, gNormBound_c C.double) (
+	fDelta_c, fDeltaBound_c, gNorm_c, gNormBound_c C.double,
+	theta_c C.double, skippedUpdates_c, segments_c, segmentsTotal_c,
+	freeVariables_c, activeVariables_c, subspaceTruncated_c C.int,
+	directionNorm_c, initialSlope_c, slope_c C.double,
+	statusMessage_c *C.char, statusMessageLength_c C.int) (
 		statusCode_c C.int) {
 
 	var x, g []float64
 
 	// Convert inputs
 	dim := int(dim_c)
-	wrapCArrayAsGoSlice_Float64(x_c, dim, &x)
-	wrapCArrayAsGoSlice_Float64(g_c, dim, &g)
+	x = wrapCArrayAsGoSlice_Float64(x_c, dim)
+	g = wrapCArrayAsGoSlice_Float64(g_c, dim)
 
 	// Get the logging function from the callback data
-	cbData := (*logCallbackData)(logCallbackData_c)
+	cbData := callbackDataFromC(callbackData_c)
+	defer cbData.timeCallback(time.Now())
+	defer cbData.recoverPanic(
+		&statusCode_c, statusMessage_c, statusMessageLength_c)
+
+	// The Fortran code counts evaluations of the function and gradient
+	// together, but does not evaluate the gradient where the value is
+	// not finite
+	skippedGradients :=
+		cbData.skippedGradients - cbData.iterationSkippedGradients
+	cbData.iterationSkippedGradients = cbData.skippedGradients
+
+	info := &OptimizationIterationInformation{
+		Iteration:   int(iteration_c),
+		FEvals:      int(fgEvals_c),
+		GEvals:      int(fgEvals_c) - skippedGradients,
+		FEvalsTotal: int(fgEvalsTotal_c),
+		GEvalsTotal: int(fgEvalsTotal_c) - cbData.skippedGradients,
+		StepLength:  float64(stepLength_c),
+		X:           x,
+		F:           float64(f_c),
+		G:           g,
+		FDelta:      float64(fDelta_c),
+		FDeltaBound: float64(fDeltaBound_c),
+		GNorm:       float64(gNorm_c),
+		GNormBound:  float64(gNormBound_c),
+
+		Theta:             float64(theta_c),
+		SkippedUpdates:    int(skippedUpdates_c),
+		Segments:          int(segments_c),
+		SegmentsTotal:     int(segmentsTotal_c),
+		FreeVariables:     int(freeVariables_c),
+		ActiveVariables:   int(activeVariables_c),
+		SubspaceTruncated: subspaceTruncated_c != 0,
+		DirectionNorm:     float64(directionNorm_c),
+		InitialSlope:      float64(initialSlope_c),
+		Slope:             float64(slope_c),
+
+		ActiveSetChanges: cbData.activeSet.update(x),
+	}
+
+	// Call the logging function
+	if cbData.logger != nil {
+		cbData.logger(info)
+	}
+
+	// Check the stop condition.  Stopping is not an error, so signal it
+	// with a warning.
+	if cbData.stopCondition != nil {
+		if stop, reason := cbData.stopCondition(info); stop {
+			if reason == "" {
+				reason = "Stopped by stop condition"
+			}
+			copyGoStringToC(reason,
+				statusMessage_c, statusMessageLength_c)
+			statusCode_c = C.int(WARNING)
+		}
+	}
+
+	return
+}
+
+// go_warning_function_callback is an adapter between the C callback and
+// the Go code for recording warnings.  Exported to C for use as a
+// function pointer.  Must match the signature of
+// lbfgsb_warning_function_type in lbfgsb_c.h.
+//
+//export go_warning_function_callback
+func go_warning_function_callback(
+	callbackData_c C.uintptr_t,
+	iteration_c, fgEvalsTotal_c, warning_c C.int,
+	f_c, gNorm_c C.double,
+	statusMessage_c *C.char, statusMessageLength_c C.int) (
+		statusCode_c C.int) {
+
+	cbData := callbackDataFromC(callbackData_c)
+	defer cbData.timeCallback(time.Now())
+	defer cbData.recoverPanic(
+		&statusCode_c, statusMessage_c, statusMessageLength_c)
 
-	// Call the logging function.  Let panics propagate through
-	// C/Fortran.
-	cbData.logger(
-		&OptimizationIterationInformation{
+	// Warnings match the termination reasons
+	warning := Warning{
+		Iteration: int(iteration_c),
+		Reason:    TerminationReason(warning_c),
+	}
+	cbData.warnings = append(cbData.warnings, warning)
+	if warning.Reason == ABNORMAL_LINE_SEARCH {
+		cbData.restarts = append(cbData.restarts, RestartStatistics{
 			Iteration:   int(iteration_c),
-			FEvals:      int(fgEvals_c),
-			GEvals:      int(fgEvals_c),
-			FEvalsTotal: int(fgEvalsTotal_c),
-			GEvalsTotal: int(fgEvalsTotal_c),
-			StepLength:  float64(stepLength_c),
-			X:           x,
+			Evaluations: int(fgEvalsTotal_c),
 			F:           float64(f_c),
-			G:           g,
-			FDelta:      float64(fDelta_c),
-			FDeltaBound: float64(fDeltaBound_c),
 			GNorm:       float64(gNorm_c),
-			GNormBound:  float64(gNormBound_c),
 		})
+	}
+	if cbData.warningHandler != nil {
+		cbData.warningHandler(warning)
+	}
+
+	return
+}
+
+// go_evaluation_function_callback is an adapter between the C callback
+// and the Go callback for observing each evaluation.  Exported to C for
+// use as a function pointer.  Must match the signature of
+// lbfgsb_evaluation_function_type in lbfgsb_c.h.
+//
+//export go_evaluation_function_callback
+func go_evaluation_function_callback(
+	callbackData_c C.uintptr_t,
+	evaluation_c, iteration_c, phase_c C.int, stepLength_c C.double,
+	dim_c C.int, x_c *C.double, f_c C.double, g_c *C.double,
+	gNorm_c C.double,
+	statusMessage_c *C.char, statusMessageLength_c C.int) (
+		statusCode_c C.int) {
+
+	cbData := callbackDataFromC(callbackData_c)
+	defer cbData.timeCallback(time.Now())
+	defer cbData.recoverPanic(
+		&statusCode_c, statusMessage_c, statusMessageLength_c)
 
+	// Phases match between EvaluationPhase and the C enum
+	dim := int(dim_c)
+	info := EvaluationInfo{
+		Evaluation: int(evaluation_c),
+		Iteration:  int(iteration_c),
+		Phase:      EvaluationPhase(phase_c),
+		StepLength: float64(stepLength_c),
+		X:          wrapCArrayAsGoSlice_Float64(x_c, dim),
+		F:          float64(f_c),
+		G:          wrapCArrayAsGoSlice_Float64(g_c, dim),
+		GNorm:      float64(gNorm_c),
+		Elapsed:    cbData.evaluationTime,
+	}
+	cbData.evaluationTime = 0
+
+	if cbData.evaluationObserver != nil {
+		cbData.evaluationObserver(info)
+	}
 	return
 }
 
+// go_checkpoint_function_callback is an adapter between the C callback
+// and the Go code for saving checkpoints.  Exported to C for use as a
+// function pointer.  Must match the signature of
+// lbfgsb_checkpoint_function_type in lbfgsb_c.h.
+//
+//export go_checkpoint_function_callback
+func go_checkpoint_function_callback(
+	callbackData_c C.uintptr_t, iteration_c C.int,
+	statusMessage_c *C.char, statusMessageLength_c C.int) (
+		statusCode_c C.int) {
+
+	cbData := callbackDataFromC(callbackData_c)
+	defer cbData.timeCallback(time.Now())
+	defer cbData.recoverPanic(
+		&statusCode_c, statusMessage_c, statusMessageLength_c)
+
+	// The whole state is in the workspace except for what the Go code
+	// records, so save both
+	history := checkpointHistory{
+		skippedGradients: cbData.skippedGradients,
+		warnings:         cbData.warnings,
+		restarts:         cbData.restarts,
+	}
+	err := writeCheckpoint(cbData.checkpointPath, cbData.workspace,
+		history, cbData.checkpointConfiguration)
+	if err != nil {
+		cbData.cause = err
+		copyGoStringToC(
+			fmt.Sprintf("Error: Checkpoint failed: %v", err),
+			statusMessage_c, statusMessageLength_c)
+		statusCode_c = C.int(FAILURE)
+	}
+
+	return
+}
+
+// nanSlice returns a slice of the given length filled with NaNs.
+func nanSlice(length int) []float64 {
+	slice := make([]float64, length)
+	for i := range slice {
+		slice[i] = math.NaN()
+	}
+	return slice
+}
+
+// secondsToDuration converts a time in seconds, as measured by the
+// Fortran code, to a duration.
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// callbackDataFromC returns the callback data whose handle was passed
+// to C (see lbfgsb_go_interface.c).
+func callbackDataFromC(callbackData_c C.uintptr_t) *callbackData {
+	return cgo.Handle(callbackData_c).Value().(*callbackData)
+}
+
+// copyGoStringToC copies a Go string into a C character buffer of the
+// given length as a null-terminated C string.  Truncates the string if
+// the buffer is too short.
+func copyGoStringToC(str string, buffer_c *C.char, length_c C.int) {
+	length := int(length_c)
+	if length <= 0 {
+		return
+	}
+	buffer := unsafe.Slice((*byte)(unsafe.Pointer(buffer_c)), length)
+	// Leave room for the terminating null
+	n := copy(buffer[:length-1], str)
+	buffer[n] = 0
+}
+
 // wrapCArrayAsGoSlice_Float64 allows a C array to be treated as a Go
-// slice.  Based on https://code.google.com/p/go-wiki/wiki/cgo.  This
-// only works if the Go and C types happen to be interoperable (binary
-// compatible), but that seems to be the case so far.
-func wrapCArrayAsGoSlice_Float64(array *C.double, length int,
-	slice *[]float64) {
-
-	sliceHeader := (*reflect.SliceHeader)(unsafe.Pointer(slice))
-	sliceHeader.Cap = length
-	sliceHeader.Len = length
-	sliceHeader.Data = uintptr(unsafe.Pointer(array))
+// slice without copying.  This only works if the Go and C types happen
+// to be interoperable (binary compatible), but that seems to be the
+// case so far.
+func wrapCArrayAsGoSlice_Float64(array *C.double, length int) []float64 {
+	return unsafe.Slice((*float64)(unsafe.Pointer(array)), length)
 }
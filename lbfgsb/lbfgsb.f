@@ -45,13 +45,15 @@ c                        March  2011
 c                                                 
 c============================================================================= 
       subroutine setulb(n, m, x, l, u, nbd, f, g, factr, pgtol, wa, iwa,
-     +                 task, iprint, csave, lsave, isave, dsave)
+     +                 task, iprint, csave, lsave, isave, dsave,
+     +                 ftol, gtol, xtol, maxstp, maxls, iout, itfile)
  
       character*60     task, csave
       logical          lsave(4)
-      integer          n, m, iprint, 
+      integer          n, m, iprint, maxls, iout, itfile,
      +                 nbd(n), iwa(3*n), isave(44)
       double precision f, factr, pgtol, x(n), l(n), u(n), g(n),
+     +                 ftol, gtol, xtol, maxstp,
 c
 c-jlm-jn
      +                 wa(2*m*n + 5*n + 11*m*m + 8*m), dsave(29)
@@ -140,8 +142,8 @@ c        0<iprint<99 print also f and |proj g| every iprint iterations;
 c        iprint=99   print details of every iteration except n-vectors;
 c        iprint=100  print also the changes of active set and final x;
 c        iprint>100  print details of every iteration including x and g;
-c       When iprint > 0, the file iterate.dat will be created to
-c                        summarize the iteration.
+c       When iprint > 0, the iterations will be summarized on unit
+c                        itfile.
 c
 c     csave is a working string of characters of length 60.
 c
@@ -205,6 +207,36 @@ c                                 the starting point of the line search;
 c         dsave(16) = the square of the 2-norm of the line search
 c                                                      direction vector.
 c
+c     ftol, gtol, and xtol are double precision variables.
+c       On entry they are the tolerances of the line search (see
+c         dcsrch): the sufficient decrease condition, the curvature
+c         condition, and the relative width of the interval of
+c         uncertainty.  The original code used ftol = 1.0d-3,
+c         gtol = 0.9d0, and xtol = 0.1d0.
+c       On exit they are unchanged.
+c
+c     maxstp is a double precision variable.
+c       On entry maxstp is the maximum 2-norm of any step taken by the
+c         line search, or zero for no maximum (as in the original code).
+c       On exit maxstp is unchanged.
+c
+c     maxls is an integer variable.
+c       On entry maxls is the maximum number of function and gradient
+c         evaluations in one line search.  The original code used 20.
+c       On exit maxls is unchanged.
+c
+c     iout is an integer variable.
+c       On entry iout is the unit to which output is written.  The
+c         original code wrote to unit 6.
+c       On exit iout is unchanged.
+c
+c     itfile is an integer variable.
+c       On entry itfile is the unit to which the summary of the
+c         iterations is written when iprint >= 1.  It must be connected
+c         by the caller.  The original code opened the file iterate.dat
+c         on unit 8.
+c       On exit itfile is unchanged.
+c
 c     Subprograms called:
 c
 c       L-BFGS-B Library ... mainlb.    
@@ -276,7 +308,8 @@ c-jlm-jn
      +  wa(lwn),wa(lsnd),wa(lz),wa(lr),wa(ld),wa(lt),wa(lxp),
      +  wa(lwa),
      +  iwa(1),iwa(n+1),iwa(2*n+1),task,iprint, 
-     +  csave,lsave,isave(22),dsave)
+     +  csave,lsave,isave(22),dsave,ftol,gtol,xtol,maxstp,maxls,
+     +  iout,itfile)
 
       return
 
@@ -287,13 +320,15 @@ c======================= The end of setulb =============================
       subroutine mainlb(n, m, x, l, u, nbd, f, g, factr, pgtol, ws, wy,
      +                  sy, ss, wt, wn, snd, z, r, d, t, xp, wa, 
      +                  index, iwhere, indx2, task,
-     +                  iprint, csave, lsave, isave, dsave)
+     +                  iprint, csave, lsave, isave, dsave,
+     +                  ftol, gtol, xtol, maxstp, maxls, iout, itfile)
       implicit none
       character*60     task, csave
       logical          lsave(4)
-      integer          n, m, iprint, nbd(n), index(n),
+      integer          n, m, iprint, maxls, iout, itfile,
+     +                 nbd(n), index(n),
      +                 iwhere(n), indx2(n), isave(23)
-      double precision f, factr, pgtol,
+      double precision f, factr, pgtol, ftol, gtol, xtol, maxstp,
      +                 x(n), l(n), u(n), g(n), z(n), r(n), d(n), t(n), 
 c-jlm-jn
      +                 xp(n), 
@@ -426,8 +461,8 @@ c        0<iprint<99 print also f and |proj g| every iprint iterations;
 c        iprint=99   print details of every iteration except n-vectors;
 c        iprint=100  print also the changes of active set and final x;
 c        iprint>100  print details of every iteration including x and g;
-c       When iprint > 0, the file iterate.dat will be created to
-c                        summarize the iteration.
+c       When iprint > 0, the iterations will be summarized on unit
+c                        itfile.
 c
 c     csave is a working string of characters of length 60.
 c
@@ -437,6 +472,11 @@ c     isave is an integer working array of dimension 23.
 c
 c     dsave is a double precision working array of dimension 29.
 c
+c     ftol, gtol, xtol, maxstp, and maxls are the line search
+c       parameters (see setulb).
+c
+c     iout and itfile are the output units (see setulb).
+c
 c
 c     Subprograms called
 c
@@ -483,7 +523,7 @@ c     ************
  
       logical          prjctd,cnstnd,boxed,updatd,wrk
       character*3      word
-      integer          i,k,nintol,itfile,iback,nskip,
+      integer          i,k,nintol,iback,nskip,
      +                 head,col,iter,itail,iupdat,
      +                 nseg,nfgv,info,ifun,
      +                 iword,nfree,nact,ileave,nenter
@@ -546,12 +586,6 @@ c           'word' records the status of subspace solutions.
 c           'info' records the termination information.
          info = 0
 
-         itfile = 8
-         if (iprint .ge. 1) then
-c                                open a summary file 'iterate.dat'
-            open (8, file = 'iterate.dat', status = 'unknown')
-         endif            
-
 c        Check the input arguments for errors.
 
          call errclb(n,m,factr,l,u,nbd,task,info,k)
@@ -559,15 +593,16 @@ c        Check the input arguments for errors.
             call prn3lb(n,x,f,task,iprint,info,itfile,
      +                  iter,nfgv,nintol,nskip,nact,sbgnrm,
      +                  zero,nseg,word,iback,stp,xstep,k,
-     +                  cachyt,sbtime,lnscht)
+     +                  cachyt,sbtime,lnscht,iout)
             return
          endif
 
-         call prn1lb(n,m,l,u,x,iprint,itfile,epsmch)
+         call prn1lb(n,m,l,u,x,iprint,itfile,epsmch,iout)
  
 c        Initialize iwhere & project x onto the feasible set.
  
-         call active(n,l,u,nbd,x,iwhere,iprint,prjctd,cnstnd,boxed) 
+         call active(n,l,u,nbd,x,iwhere,iprint,prjctd,cnstnd,boxed,
+     +               iout)
 
 c        The end of the initialization.
 
@@ -580,7 +615,6 @@ c          restore local variables.
          updatd = lsave(4)
 
          nintol = isave(1)
-         itfile = isave(3)
          iback  = isave(4)
          nskip  = isave(5)
          head   = isave(6)
@@ -645,7 +679,7 @@ c     Compute the infinity norm of the (-) projected gradient.
       call projgr(n,l,u,nbd,x,g,sbgnrm)
   
       if (iprint .ge. 1) then
-         write (6,1002) iter,f,sbgnrm
+         write (iout,1002) iter,f,sbgnrm
          write (itfile,1003) iter,nfgv,sbgnrm,f
       endif
       if (sbgnrm .le. pgtol) then
@@ -657,7 +691,7 @@ c                                terminate the algorithm.
 c ----------------- the beginning of the loop --------------------------
  
  222  continue
-      if (iprint .ge. 99) write (6,1001) iter + 1
+      if (iprint .ge. 99) write (iout,1001) iter + 1
       iword = -1
 c
       if (.not. cnstnd .and. col .gt. 0) then 
@@ -678,10 +712,10 @@ cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc
       call cauchy(n,x,l,u,nbd,g,indx2,iwhere,t,d,z,
      +            m,wy,ws,sy,wt,theta,col,head,
      +            wa(1),wa(2*m+1),wa(4*m+1),wa(6*m+1),nseg,
-     +            iprint, sbgnrm, info, epsmch)
+     +            iprint, sbgnrm, info, epsmch, iout)
       if (info .ne. 0) then 
 c         singular triangular system detected; refresh the lbfgs memory.
-         if(iprint .ge. 1) write (6, 1005)
+         if(iprint .ge. 1) write (iout, 1005)
          info   = 0
          col    = 0
          head   = 1
@@ -700,7 +734,7 @@ c     Count the entering and leaving variables for iter > 0;
 c     find the index set of free and active variables at the GCP.
 
       call freev(n,nfree,index,nenter,ileave,indx2,
-     +           iwhere,wrk,updatd,cnstnd,iprint,iter)
+     +           iwhere,wrk,updatd,cnstnd,iprint,iter,iout)
       nact = n - nfree
 
  333  continue
@@ -729,7 +763,7 @@ c                     [ 0  I]
       if (info .ne. 0) then
 c          nonpositive definiteness in Cholesky factorization;
 c          refresh the lbfgs memory and restart the iteration.
-         if(iprint .ge. 1) write (6, 1006)
+         if(iprint .ge. 1) write (iout, 1006)
          info   = 0
          col    = 0
          head   = 1
@@ -750,12 +784,13 @@ c                                                   from 'cauchy').
 c-jlm-jn   call the direct method. 
 
       call subsm( n, m, nfree, index, l, u, nbd, z, r, xp, ws, wy,
-     +           theta, x, g, col, head, iword, wa, wn, iprint, info)
+     +           theta, x, g, col, head, iword, wa, wn, iprint, info,
+     +           iout)
  444  continue
       if (info .ne. 0) then 
 c          singular triangular system detected;
 c          refresh the lbfgs memory and restart the iteration.
-         if(iprint .ge. 1) write (6, 1005)
+         if(iprint .ge. 1) write (iout, 1005)
          info   = 0
          col    = 0
          head   = 1
@@ -786,8 +821,9 @@ c     Generate the search direction d:=z-x.
  666  continue
       call lnsrlb(n,l,u,nbd,x,f,fold,gd,gdold,g,d,r,t,z,stp,dnorm,
      +            dtd,xstep,stpmx,iter,ifun,iback,nfgv,info,task,
-     +            boxed,cnstnd,csave,isave(22),dsave(17))
-      if (info .ne. 0 .or. iback .ge. 20) then
+     +            boxed,cnstnd,csave,isave(22),dsave(17),
+     +            ftol,gtol,xtol,maxstp,iout)
+      if (info .ne. 0 .or. iback .ge. maxls) then
 c          restore the previous iterate.
          call dcopy(n,t,1,x,1)
          call dcopy(n,r,1,g,1)
@@ -806,7 +842,7 @@ c                restore the actual number of f and g evaluations etc.
             goto 999
          else
 c             refresh the lbfgs memory and restart the iteration.
-            if(iprint .ge. 1) write (6, 1008)
+            if(iprint .ge. 1) write (iout, 1008)
             if (info .eq. 0) nfgv = nfgv - 1
             info   = 0
             col    = 0
@@ -835,7 +871,7 @@ c        Compute the infinity norm of the projected (-)gradient.
 c        Print iteration information.
 
          call prn2lb(n,x,f,g,iprint,itfile,iter,nfgv,nact,
-     +               sbgnrm,nseg,word,iword,iback,stp,xstep)
+     +               sbgnrm,nseg,word,iword,iback,stp,xstep,iout)
          goto 1000
       endif
  777  continue
@@ -876,7 +912,7 @@ c     Compute d=newx-oldx, r=newg-oldg, rr=y'y and dr=y's.
 c                            skip the L-BFGS update.
          nskip = nskip + 1
          updatd = .false.
-         if (iprint .ge. 1) write (6,1004) dr, ddum
+         if (iprint .ge. 1) write (iout,1004) dr, ddum
          goto 888
       endif 
  
@@ -904,7 +940,7 @@ c           J' stored in the upper triangular of wt.
       if (info .ne. 0) then 
 c          nonpositive definiteness in Cholesky factorization;
 c          refresh the lbfgs memory and restart the iteration.
-         if(iprint .ge. 1) write (6, 1007)
+         if(iprint .ge. 1) write (iout, 1007)
          info = 0
          col = 0
          head = 1
@@ -930,7 +966,7 @@ c -------------------- the end of the loop -----------------------------
       call prn3lb(n,x,f,task,iprint,info,itfile,
      +            iter,nfgv,nintol,nskip,nact,sbgnrm,
      +            time,nseg,word,iback,stp,xstep,k,
-     +            cachyt,sbtime,lnscht)
+     +            cachyt,sbtime,lnscht,iout)
  1000 continue
 
 c     Save local variables.
@@ -1002,10 +1038,10 @@ c     Save local variables.
 c======================= The end of mainlb =============================
 
       subroutine active(n, l, u, nbd, x, iwhere, iprint,
-     +                  prjctd, cnstnd, boxed)
+     +                  prjctd, cnstnd, boxed, iout)
 
       logical          prjctd, cnstnd, boxed
-      integer          n, iprint, nbd(n), iwhere(n)
+      integer          n, iprint, iout, nbd(n), iwhere(n)
       double precision x(n), l(n), u(n)
 
 c     ************
@@ -1087,13 +1123,13 @@ c                   this variable is always fixed
   20  continue
 
       if (iprint .ge. 0) then
-         if (prjctd) write (6,*)
+         if (prjctd) write (iout,*)
      +   'The initial X is infeasible.  Restart with its projection.'
          if (.not. cnstnd)
-     +      write (6,*) 'This problem is unconstrained.'
+     +      write (iout,*) 'This problem is unconstrained.'
       endif
 
-      if (iprint .gt. 0) write (6,1001) nbdd
+      if (iprint .gt. 0) write (iout,1001) nbdd
 
  1001 format (/,'At X0 ',i9,' variables are exactly at the bounds') 
 
@@ -1221,9 +1257,9 @@ c======================== The end of bmv ===============================
 
       subroutine cauchy(n, x, l, u, nbd, g, iorder, iwhere, t, d, xcp, 
      +                  m, wy, ws, sy, wt, theta, col, head, p, c, wbp, 
-     +                  v, nseg, iprint, sbgnrm, info, epsmch)
+     +                  v, nseg, iprint, sbgnrm, info, epsmch, iout)
       implicit none
-      integer          n, m, head, col, nseg, iprint, info, 
+      integer          n, m, head, col, nseg, iprint, info, iout,
      +                 nbd(n), iorder(n), iwhere(n)
       double precision theta, epsmch,
      +                 x(n), l(n), u(n), g(n), t(n), d(n), xcp(n),
@@ -1421,7 +1457,7 @@ c       compute the Cauchy direction d and the breakpoints t; initialize
 c       the derivative f1 and the vector p = W'd (for theta = 1).
  
       if (sbgnrm .le. zero) then
-         if (iprint .ge. 0) write (6,*) 'Subgnorm = 0.  GCP = X.'
+         if (iprint .ge. 0) write (iout,*) 'Subgnorm = 0.  GCP = X.'
          call dcopy(n,x,1,xcp,1)
          return
       endif 
@@ -1432,7 +1468,7 @@ c       the derivative f1 and the vector p = W'd (for theta = 1).
       bkmin = zero
       col2 = 2*col
       f1 = zero
-      if (iprint .ge. 99) write (6,3010)
+      if (iprint .ge. 99) write (iout,3010)
 
 c     We set p to zero and build it up as we determine d.
 
@@ -1522,7 +1558,7 @@ c     Initialize GCP xcp = x.
 
       if (nbreak .eq. 0 .and. nfree .eq. n + 1) then
 c                  is a zero vector, return with the initial xcp as GCP.
-         if (iprint .gt. 100) write (6,1010) (xcp(i), i = 1, n)
+         if (iprint .gt. 100) write (iout,1010) (xcp(i), i = 1, n)
          return
       endif    
  
@@ -1545,7 +1581,7 @@ c     Initialize derivative f2.
       tsum = zero
       nseg = 1
       if (iprint .ge. 99) 
-     +   write (6,*) 'There are ',nbreak,'  breakpoints '
+     +   write (iout,*) 'There are ',nbreak,'  breakpoints '
  
 c     If there are no breakpoints, locate the GCP and return. 
  
@@ -1590,9 +1626,9 @@ c           (if iter=2, initialize heap).
       dt = tj - tj0
  
       if (dt .ne. zero .and. iprint .ge. 100) then
-         write (6,4011) nseg,f1,f2
-         write (6,5010) dt
-         write (6,6010) dtm
+         write (iout,4011) nseg,f1,f2
+         write (iout,5010) dt
+         write (iout,6010) dtm
       endif          
  
 c     If a minimizer is within this interval, locate the GCP and return. 
@@ -1616,7 +1652,7 @@ c       reset the corresponding component of d to zero.
          xcp(ibp) = l(ibp)
          iwhere(ibp) = 1
       endif
-      if (iprint .ge. 100) write (6,*) 'Variable  ',ibp,'  is fixed.'
+      if (iprint .ge. 100) write (iout,*) 'Variable  ',ibp,'  is fixed.'
       if (nleft .eq. 0 .and. nbreak .eq. n) then
 c                                             all n variables are fixed,
 c                                                return with xcp as GCP.
@@ -1680,10 +1716,10 @@ c------------------- the end of the loop -------------------------------
  
  888  continue
       if (iprint .ge. 99) then
-         write (6,*)
-         write (6,*) 'GCP found in this segment'
-         write (6,4010) nseg,f1,f2
-         write (6,6010) dtm
+         write (iout,*)
+         write (iout,*) 'GCP found in this segment'
+         write (iout,4010) nseg,f1,f2
+         write (iout,6010) dtm
       endif 
       if (dtm .le. zero) dtm = zero
       tsum = tsum + dtm
@@ -1699,8 +1735,8 @@ c     Update c = c + dtm*p = W'(x^c - x)
 c       which will be used in computing r = Z'(B(x^c - x) + g).
  
       if (col .gt. 0) call daxpy(col2,dtm,p,1,c,1)
-      if (iprint .gt. 100) write (6,1010) (xcp(i),i = 1,n)
-      if (iprint .ge. 99) write (6,2010)
+      if (iprint .gt. 100) write (iout,1010) (xcp(i),i = 1,n)
+      if (iprint .ge. 99) write (iout,2010)
 
  1010 format ('Cauchy X =  ',/,(4x,1p,6(1x,d11.4)))
  2010 format (/,'---------------- exit CAUCHY----------------------',/)
@@ -2239,9 +2275,9 @@ c        J' stored in the upper triangle of wt.
 c======================= The end of formt ==============================
  
       subroutine freev(n, nfree, index, nenter, ileave, indx2, 
-     +                 iwhere, wrk, updatd, cnstnd, iprint, iter)
+     +                 iwhere, wrk, updatd, cnstnd, iprint, iter, iout)
 
-      integer n, nfree, nenter, ileave, iprint, iter, 
+      integer n, nfree, nenter, ileave, iprint, iter, iout,
      +        index(n), indx2(n), iwhere(n)
       logical wrk, updatd, cnstnd
 
@@ -2298,7 +2334,7 @@ c            write(6,*) ' index = ', i
             if (iwhere(k) .gt. 0) then
                ileave = ileave - 1
                indx2(ileave) = k
-               if (iprint .ge. 100) write (6,*)
+               if (iprint .ge. 100) write (iout,*)
      +             'Variable ',k,' leaves the set of free variables'
             endif
   20     continue
@@ -2307,11 +2343,11 @@ c            write(6,*) ' index = ', i
             if (iwhere(k) .le. 0) then
                nenter = nenter + 1
                indx2(nenter) = k
-               if (iprint .ge. 100) write (6,*)
+               if (iprint .ge. 100) write (iout,*)
      +             'Variable ',k,' enters the set of free variables'
             endif
   22     continue
-         if (iprint .ge. 99) write (6,*)
+         if (iprint .ge. 99) write (iout,*)
      +       n+1-ileave,' variables leave; ',nenter,' variables enter'
       endif
       wrk = (ileave .lt. n+1) .or. (nenter .gt. 0) .or. updatd
@@ -2329,7 +2365,7 @@ c     Find the index set of free and active variables at the GCP.
             index(iact) = i
          endif
   24  continue
-      if (iprint .ge. 99) write (6,*)
+      if (iprint .ge. 99) write (iout,*)
      +      nfree,' variables are free at GCP ',iter + 1  
 
       return
@@ -2453,15 +2489,15 @@ c====================== The end of hpsolb ==============================
       subroutine lnsrlb(n, l, u, nbd, x, f, fold, gd, gdold, g, d, r, t,
      +                  z, stp, dnorm, dtd, xstep, stpmx, iter, ifun,
      +                  iback, nfgv, info, task, boxed, cnstnd, csave,
-     +                  isave, dsave)
+     +                  isave, dsave, ftol, gtol, xtol, maxstp, iout)
 
       character*60     task, csave
       logical          boxed, cnstnd
-      integer          n, iter, ifun, iback, nfgv, info,
+      integer          n, iter, ifun, iback, nfgv, info, iout,
      +                 nbd(n), isave(2)
       double precision f, fold, gd, gdold, stp, dnorm, dtd, xstep,
      +                 stpmx, x(n), l(n), u(n), g(n), d(n), r(n), t(n),
-     +                 z(n), dsave(13)
+     +                 z(n), dsave(13), ftol, gtol, xtol, maxstp
 c     **********
 c
 c     Subroutine lnsrlb
@@ -2470,6 +2506,9 @@ c     This subroutine calls subroutine dcsrch from the Minpack2 library
 c       to perform the line search.  Subroutine dscrch is safeguarded so
 c       that all trial points lie within the feasible region.
 c
+c     ftol, gtol, xtol, and maxstp are the line search parameters (see
+c       setulb).  If maxstp is positive, no step is longer than it.
+c
 c     Subprograms called:
 c
 c       Minpack2 Library ... dcsrch.
@@ -2493,8 +2532,6 @@ c     **********
       double           precision ddot,a1,a2
       double precision one,zero,big
       parameter        (one=1.0d0,zero=0.0d0,big=1.0d+10)
-      double precision ftol,gtol,xtol
-      parameter        (ftol=1.0d-3,gtol=0.9d0,xtol=0.1d0)
 
       if (task(1:5) .eq. 'FG_LN') goto 556
 
@@ -2537,6 +2574,14 @@ c     Determine the maximum step length.
          stp = one
       endif 
 
+c     Limit the length of the step if asked (and if there is a
+c     direction to limit).
+
+      if (maxstp .gt. zero .and. dnorm .gt. zero) then
+         stpmx = min(stpmx, maxstp/dnorm)
+         stp = min(stp, stpmx)
+      endif
+
       call dcopy(n,x,1,t,1)
       call dcopy(n,g,1,r,1)
       fold = f
@@ -2550,8 +2595,11 @@ c     Determine the maximum step length.
          if (gd .ge. zero) then
 c                               the directional derivative >=0.
 c                               Line search is impossible.
-c           Leave this output unguarded as `iprint` is not defined.
-            write(6,*)' ascent direction in projection gd = ', gd
+c           `iprint` is not defined here, so only leave out this
+c           output if there is no unit to print to (-1).
+            if (iout .ne. -1) then
+               write(iout,*)' ascent direction in projection gd = ', gd
+            endif
             info = -4
             return
          endif
@@ -2669,9 +2717,9 @@ c                                             and the last column of SS:
 
 c======================= The end of matupd =============================
 
-      subroutine prn1lb(n, m, l, u, x, iprint, itfile, epsmch)
+      subroutine prn1lb(n, m, l, u, x, iprint, itfile, epsmch, iout)
  
-      integer n, m, iprint, itfile
+      integer n, m, iprint, itfile, iout
       double precision epsmch, x(n), l(n), u(n)
 
 c     ************
@@ -2698,16 +2746,16 @@ c     ************
       integer i
 
       if (iprint .ge. 0) then
-         write (6,7001) epsmch
-         write (6,*) 'N = ',n,'    M = ',m
+         write (iout,7001) epsmch
+         write (iout,*) 'N = ',n,'    M = ',m
          if (iprint .ge. 1) then
             write (itfile,2001) epsmch
             write (itfile,*)'N = ',n,'    M = ',m
             write (itfile,9001)
             if (iprint .gt. 100) then
-               write (6,1004) 'L =',(l(i),i = 1,n)
-               write (6,1004) 'X0 =',(x(i),i = 1,n)
-               write (6,1004) 'U =',(u(i),i = 1,n)
+               write (iout,1004) 'L =',(l(i),i = 1,n)
+               write (iout,1004) 'X0 =',(x(i),i = 1,n)
+               write (iout,1004) 'U =',(u(i),i = 1,n)
             endif 
          endif
       endif 
@@ -2741,10 +2789,11 @@ c     ************
 c======================= The end of prn1lb =============================
 
       subroutine prn2lb(n, x, f, g, iprint, itfile, iter, nfgv, nact, 
-     +                  sbgnrm, nseg, word, iword, iback, stp, xstep)
+     +                  sbgnrm, nseg, word, iword, iback, stp, xstep,
+     +                  iout)
  
       character*3      word
-      integer          n, iprint, itfile, iter, nfgv, nact, nseg,
+      integer          n, iprint, itfile, iout, iter, nfgv, nact, nseg,
      +                 iword, iback
       double precision f, sbgnrm, stp, xstep, x(n), g(n)
 
@@ -2784,15 +2833,16 @@ c                             the truncated Newton step has been used.
          word = '---'
       endif
       if (iprint .ge. 99) then
-         write (6,*) 'LINE SEARCH',iback,' times; norm of step = ',xstep
-         write (6,2001) iter,f,sbgnrm
+         write (iout,*) 'LINE SEARCH',iback,' times; norm of step = ',
+     +                  xstep
+         write (iout,2001) iter,f,sbgnrm
          if (iprint .gt. 100) then      
-            write (6,1004) 'X =',(x(i), i = 1, n)
-            write (6,1004) 'G =',(g(i), i = 1, n)
+            write (iout,1004) 'X =',(x(i), i = 1, n)
+            write (iout,1004) 'G =',(g(i), i = 1, n)
          endif
       else if (iprint .gt. 0) then 
          imod = mod(iter,iprint)
-         if (imod .eq. 0) write (6,2001) iter,f,sbgnrm
+         if (imod .eq. 0) write (iout,2001) iter,f,sbgnrm
       endif
       if (iprint .ge. 1) write (itfile,3001)
      +          iter,nfgv,nseg,nact,word,iback,stp,xstep,sbgnrm,f
@@ -2811,12 +2861,12 @@ c======================= The end of prn2lb =============================
       subroutine prn3lb(n, x, f, task, iprint, info, itfile, 
      +                  iter, nfgv, nintol, nskip, nact, sbgnrm, 
      +                  time, nseg, word, iback, stp, xstep, k, 
-     +                  cachyt, sbtime, lnscht)
+     +                  cachyt, sbtime, lnscht, iout)
  
       character*60     task
       character*3      word
-      integer          n, iprint, info, itfile, iter, nfgv, nintol,
-     +                 nskip, nact, nseg, iback, k
+      integer          n, iprint, info, itfile, iout, iter, nfgv,
+     +                 nintol, nskip, nact, nseg, iback, k
       double precision f, sbgnrm, time, stp, xstep, cachyt, sbtime,
      +                 lnscht, x(n)
 
@@ -2846,31 +2896,32 @@ c     ************
       if (task(1:5) .eq. 'ERROR') goto 999
 
       if (iprint .ge. 0) then
-         write (6,3003)
-         write (6,3004)
-         write(6,3005) n,iter,nfgv,nintol,nskip,nact,sbgnrm,f
+         write (iout,3003)
+         write (iout,3004)
+         write(iout,3005) n,iter,nfgv,nintol,nskip,nact,sbgnrm,f
          if (iprint .ge. 100) then
-            write (6,1004) 'X =',(x(i),i = 1,n)
+            write (iout,1004) 'X =',(x(i),i = 1,n)
          endif  
-         if (iprint .ge. 1) write (6,*) ' F =',f
+         if (iprint .ge. 1) write (iout,*) ' F =',f
       endif 
  999  continue
       if (iprint .ge. 0) then
-         write (6,3009) task
+         write (iout,3009) task
          if (info .ne. 0) then
-            if (info .eq. -1) write (6,9011)
-            if (info .eq. -2) write (6,9012)
-            if (info .eq. -3) write (6,9013)
-            if (info .eq. -4) write (6,9014)
-            if (info .eq. -5) write (6,9015)
-            if (info .eq. -6) write (6,*)' Input nbd(',k,') is invalid.'
+            if (info .eq. -1) write (iout,9011)
+            if (info .eq. -2) write (iout,9012)
+            if (info .eq. -3) write (iout,9013)
+            if (info .eq. -4) write (iout,9014)
+            if (info .eq. -5) write (iout,9015)
+            if (info .eq. -6)
+     +         write (iout,*)' Input nbd(',k,') is invalid.'
             if (info .eq. -7) 
-     +      write (6,*)' l(',k,') > u(',k,').  No feasible solution.'
-            if (info .eq. -8) write (6,9018)
-            if (info .eq. -9) write (6,9019)
+     +      write (iout,*)' l(',k,') > u(',k,').  No feasible solution.'
+            if (info .eq. -8) write (iout,9018)
+            if (info .eq. -9) write (iout,9019)
          endif
-         if (iprint .ge. 1) write (6,3007) cachyt,sbtime,lnscht
-         write (6,3008) time
+         if (iprint .ge. 1) write (iout,3007) cachyt,sbtime,lnscht
+         write (iout,3008) time
          if (iprint .ge. 1) then
             if (info .eq. -4 .or. info .eq. -9) then
                write (itfile,3002)
@@ -2991,9 +3042,9 @@ c======================= The end of projgr =============================
 
       subroutine subsm ( n, m, nsub, ind, l, u, nbd, x, d, xp, ws, wy,
      +                   theta, xx, gg,
-     +                   col, head, iword, wv, wn, iprint, info )
+     +                   col, head, iword, wv, wn, iprint, info, iout )
       implicit none
-      integer          n, m, nsub, col, head, iword, iprint, info, 
+      integer          n, m, nsub, col, head, iword, iprint, info, iout,
      +                 ind(nsub), nbd(n)
       double precision theta, 
      +                 l(n), u(n), x(n), d(n), xp(n), xx(n), gg(n),
@@ -3187,7 +3238,7 @@ c
       double precision dd_p
 
       if (nsub .le. 0) return
-      if (iprint .ge. 99) write (6,1001)
+      if (iprint .ge. 99) write (iout,1001)
 
 c     Compute wv = W'Zd.
 
@@ -3281,8 +3332,8 @@ c
       if ( dd_p .gt.zero ) then
          call dcopy( n, xp, 1, x, 1 )
          if (iprint .ge. 0) then
-            write(6,*) ' Positive dir derivative in projection '
-            write(6,*) ' Using the backtracking step '
+            write(iout,*) ' Positive dir derivative in projection '
+            write(iout,*) ' Using the backtracking step '
          endif
       else
          go to 911
@@ -3337,7 +3388,7 @@ c
 cccccc
  911  continue
 
-      if (iprint .ge. 99) write (6,1004)
+      if (iprint .ge. 99) write (iout,1004)
 
  1001 format (/,'----------------SUBSM entered-----------------',/)
  1004 format (/,'----------------exit SUBSM --------------------',/)
@@ -6,6 +6,8 @@
 #ifndef __LBFGSB_C_H__
 #define __LBFGSB_C_H__
 
+#include <stdint.h>
+
 // Status codes for exit statuses of L-BFGS-B and related code.  See the
 // documentation in the Fortran module.
 enum lbfgsb_status {
@@ -17,6 +19,47 @@ enum lbfgsb_status {
   LBFGSB_STATUS_INTERNAL_ERROR
 };
 
+// Reasons for termination of L-BFGS-B.  See the documentation in the
+// Fortran module.
+enum lbfgsb_reason {
+  LBFGSB_REASON_UNKNOWN = 0,
+  LBFGSB_REASON_CONVERGED_PROJECTED_GRADIENT,
+  LBFGSB_REASON_CONVERGED_RELATIVE_REDUCTION,
+  LBFGSB_REASON_ABNORMAL_LINE_SEARCH,
+  LBFGSB_REASON_ROUNDING_ERRORS,
+  LBFGSB_REASON_XTOL_TEST_SATISFIED,
+  LBFGSB_REASON_STEP_AT_MAXIMUM,
+  LBFGSB_REASON_STEP_AT_MINIMUM,
+  LBFGSB_REASON_ITERATION_LIMIT,
+  LBFGSB_REASON_EVALUATION_LIMIT,
+  LBFGSB_REASON_CALLBACK_STOP,
+  LBFGSB_REASON_CALLBACK_ERROR,
+  LBFGSB_REASON_INVALID_INPUT,
+  LBFGSB_REASON_UNRECOGNIZED_TASK
+};
+
+// Requests of the step-wise (reverse-communication) interface.  See the
+// documentation in the Fortran module.
+enum lbfgsb_request {
+  LBFGSB_REQUEST_DONE = 0,
+  LBFGSB_REQUEST_EVALUATE,
+  LBFGSB_REQUEST_NEW_ITERATE
+};
+
+// Phases of the optimization in which an evaluation happens.  See the
+// documentation in the Fortran module.
+enum lbfgsb_phase {
+  LBFGSB_PHASE_START = 0,
+  LBFGSB_PHASE_LINE_SEARCH,
+  LBFGSB_PHASE_RESTART
+};
+
+// Unit that means nothing is printed.  See the documentation in the
+// Fortran module.
+enum {
+  LBFGSB_NO_UNIT = -1
+};
+
 // Signature of objective function callback.  Matches 'function
 // objective_function_c', explained in Fortran module.
 typedef int (*lbfgsb_objective_function_type)
@@ -24,7 +67,7 @@ typedef int (*lbfgsb_objective_function_type)
  int dim,
  double *point,
  double *objective_function_value,
- void *callback_data,
+ uintptr_t callback_data,
  char *status_message,
  int status_message_length
  );
@@ -36,7 +79,21 @@ typedef int (*lbfgsb_objective_gradient_type)
  int dim,
  double *point,
  double *objective_function_gradient,
- void *callback_data,
+ uintptr_t callback_data,
+ char *status_message,
+ int status_message_length
+ );
+
+// Signature of combined objective function and gradient callback.
+// Matches 'function objective_function_gradient_c', explained in
+// Fortran module.
+typedef int (*lbfgsb_objective_function_gradient_type)
+(
+ int dim,
+ double *point,
+ double *objective_function_value,
+ double *objective_function_gradient,
+ uintptr_t callback_data,
  char *status_message,
  int status_message_length
  );
@@ -45,7 +102,7 @@ typedef int (*lbfgsb_objective_gradient_type)
 // log_function_c', explained in Fortran module.
 typedef int (*lbfgsb_log_function_type)
 (
- void *callback_data,
+ uintptr_t callback_data,
  int iteration,
  int fg_evals,
  int fg_evals_total,
@@ -57,17 +114,100 @@ typedef int (*lbfgsb_log_function_type)
  double f_delta,
  double f_delta_bound,
  double g_norm,
- double g_norm_bound
+ double g_norm_bound,
+ double theta,
+ int skipped_updates,
+ int segments,
+ int segments_total,
+ int free_variables,
+ int active_variables,
+ int subspace_truncated,
+ double direction_norm,
+ double initial_slope,
+ double slope,
+ char *status_message,
+ int status_message_length
+ );
+
+// Signature of warning function callback.  Matches 'function
+// warning_function_c', explained in Fortran module.
+typedef int (*lbfgsb_warning_function_type)
+(
+ uintptr_t callback_data,
+ int iteration,
+ int fg_evals_total,
+ int warning,
+ double f,
+ double g_norm,
+ char *status_message,
+ int status_message_length
+ );
+
+// Signature of evaluation function callback.  Matches 'function
+// evaluation_function_c', explained in Fortran module.
+typedef int (*lbfgsb_evaluation_function_type)
+(
+ uintptr_t callback_data,
+ int evaluation,
+ int iteration,
+ int phase,
+ double step_length,
+ int dim,
+ double *x,
+ double f,
+ double *g,
+ double g_norm,
+ char *status_message,
+ int status_message_length
+ );
+
+// Signature of checkpointing function callback.  Matches 'function
+// checkpoint_function_c', explained in Fortran module.
+typedef int (*lbfgsb_checkpoint_function_type)
+(
+ uintptr_t callback_data,
+ int iteration,
+ char *status_message,
+ int status_message_length
+ );
+
+// Signature of output opener.  Matches 'function lbfgsb_open_output',
+// explained in Fortran module.
+int lbfgsb_open_output
+(
+ char *path,
+ int append,
+ int *unit
+ );
+
+// Signature of output closer.  Matches 'subroutine
+// lbfgsb_close_output', explained in Fortran module.
+void lbfgsb_close_output
+(
+ int unit
+ );
+
+// Signature of workspace size calculator.  Matches 'subroutine
+// lbfgsb_workspace_size', explained in Fortran module.
+void lbfgsb_workspace_size
+(
+ int dim,
+ int approximation_size,
+ int64_t *real_size,
+ int64_t *int_size,
+ int64_t *char_size
  );
 
 // Signature of L-BFGS-B minimizer.  Matches 'function lbfgsb_minimize',
 // explained in Fortran module.
 int lbfgsb_minimize
 (
- // Callbacks for objective function and gradient
+ // Callbacks for objective function and gradient (separate or
+ // combined)
  lbfgsb_objective_function_type objective_function,
  lbfgsb_objective_gradient_type objective_gradient,
- void *callback_data,
+ lbfgsb_objective_function_gradient_type objective_function_gradient,
+ uintptr_t callback_data,
 
  // Dimensionality, number of variables
  int dim,
@@ -81,21 +221,155 @@ int lbfgsb_minimize
  int approximation_size,
  double f_tolerance,
  double g_tolerance,
+ int max_iterations,
+ int max_evaluations,
+ int max_restarts,
+ double ls_f_tolerance,
+ double ls_g_tolerance,
+ double ls_x_tolerance,
+ double max_step,
+ int max_ls_evaluations,
 
  // Input
  double *initial_point,
 
+ // Warm start
+ int initial_memory_size,
+ double *initial_s,
+ double *initial_y,
+ double initial_theta,
+
+ // Workspace
+ double *real_workspace,
+ int *int_workspace,
+ char *char_workspace,
+ int resume,
+
  // Result
  double *min_x,
  double *min_f,
  double *min_g,
+ int *min_fallback,
  int *iters,
  int *evals,
+ int *recoveries,
+ int *termination_reason,
+
+ // Statistics
+ double *min_g_norm,
+ int *skipped_updates,
+ double *cauchy_time,
+ double *subspace_time,
+ double *line_search_time,
+
+ // Final limited memory
+ int *final_memory_size,
+ double *final_s,
+ double *final_y,
+ double *final_theta,
 
  // Printing, logging
  int fortran_print_control,
+ int fortran_output_unit,
+ int fortran_iterate_unit,
  lbfgsb_log_function_type log_function,
- void *log_function_callback_data,
+ uintptr_t log_function_callback_data,
+
+ // Warnings
+ lbfgsb_warning_function_type warning_function,
+ uintptr_t warning_function_callback_data,
+
+ // Evaluations
+ lbfgsb_evaluation_function_type evaluation_function,
+ uintptr_t evaluation_function_callback_data,
+
+ // Checkpointing
+ int checkpoint_interval,
+ lbfgsb_checkpoint_function_type checkpoint_function,
+ uintptr_t checkpoint_function_callback_data,
+
+ // Exit status
+ char *status_message,
+ int status_message_length
+ );
+
+// Signature of step-wise L-BFGS-B minimizer.  Matches 'function
+// lbfgsb_step', explained in Fortran module.
+int lbfgsb_step
+(
+ // Dimensionality, number of variables
+ int dim,
+
+ // Bounds
+ int *bounds_control,
+ double *lower_bounds,
+ double *upper_bounds,
+
+ // Parameters
+ int approximation_size,
+ double f_tolerance,
+ double g_tolerance,
+ int max_iterations,
+ int max_evaluations,
+ int max_restarts,
+ double ls_f_tolerance,
+ double ls_g_tolerance,
+ double ls_x_tolerance,
+ double max_step,
+ int max_ls_evaluations,
+
+ // Input
+ double *initial_point,
+
+ // Warm start
+ int initial_memory_size,
+ double *initial_s,
+ double *initial_y,
+ double initial_theta,
+
+ // Workspace
+ double *real_workspace,
+ int *int_workspace,
+ char *char_workspace,
+ int start,
+
+ // Communication
+ int caller_status,
+ double f,
+ double *g,
+ int *request,
+ double *x,
+ int *warning,
+ double *iterate_f,
+ double *iterate_g_norm,
+
+ // Result
+ double *min_x,
+ double *min_f,
+ double *min_g,
+ int *min_fallback,
+ int *iters,
+ int *evals,
+ int *recoveries,
+ int *termination_reason,
+
+ // Statistics
+ double *min_g_norm,
+ int *skipped_updates,
+ double *cauchy_time,
+ double *subspace_time,
+ double *line_search_time,
+
+ // Final limited memory
+ int *final_memory_size,
+ double *final_s,
+ double *final_y,
+ double *final_theta,
+
+ // Printing
+ int fortran_print_control,
+ int fortran_output_unit,
+ int fortran_iterate_unit,
 
  // Exit status
  char *status_message,
@@ -5,7 +5,10 @@
 // needed solely to pass the addresses of the exported Go callbacks to C
 // because Go and C function pointers are not interoperable.  (Otherwise
 // this wouldn't be needed as Go can directly call Fortran code that
-// has been exposed to C with bind(c).)
+// has been exposed to C with bind(c).)  The callback data is a Go
+// handle (runtime/cgo.Handle) rather than a pointer, because Go may not
+// pass C a pointer to memory that contains Go pointers.  It is passed
+// through as an integer and never as a pointer.
 
 #include <stddef.h>
 
@@ -15,7 +18,8 @@
 
 int lbfgsb_minimize_c
 (
- void *callback_data,
+ uintptr_t callback_handle,
+ int combined_objective,
  int dim,
  int *bounds_control,
  double *lower_bounds,
@@ -23,23 +27,76 @@ int lbfgsb_minimize_c
  int approximation_size,
  double f_tolerance,
  double g_tolerance,
+ int max_iterations,
+ int max_evaluations,
+ int max_restarts,
+ double ls_f_tolerance,
+ double ls_g_tolerance,
+ double ls_x_tolerance,
+ double max_step,
+ int max_ls_evaluations,
  double *initial_point,
+ int initial_memory_size,
+ double *initial_s,
+ double *initial_y,
+ double initial_theta,
+ double *real_workspace,
+ int *int_workspace,
+ char *char_workspace,
+ int resume,
  double *min_x,
  double *min_f,
  double *min_g,
+ int *min_fallback,
  int *iters,
  int *evals,
+ int *recoveries,
+ int *termination_reason,
+ double *min_g_norm,
+ int *skipped_updates,
+ double *cauchy_time,
+ double *subspace_time,
+ double *line_search_time,
+ int *final_memory_size,
+ double *final_s,
+ double *final_y,
+ double *final_theta,
  int fortran_print_control,
+ int fortran_output_unit,
+ int fortran_iterate_unit,
  int do_logging,
- void *log_function_callback_data,
+ int observe_evaluations,
+ int checkpoint_interval,
  char *status_message,
  int status_message_length
  )
 {
+  // Only pass the combined objective function if asked
+  lbfgsb_objective_function_gradient_type
+    objective_function_gradient_pointer = NULL;
+  if (combined_objective) {
+    objective_function_gradient_pointer =
+      go_objective_function_gradient_callback;
+  }
+
   // Only pass the logging function if asked
   lbfgsb_log_function_type log_function_pointer = NULL;
+  uintptr_t log_function_callback_data = 0;
   if (do_logging) {
     log_function_pointer = go_log_function_callback;
+    log_function_callback_data = callback_handle;
+  }
+
+  // Only pass the evaluation function if asked
+  lbfgsb_evaluation_function_type evaluation_function_pointer = NULL;
+  if (observe_evaluations) {
+    evaluation_function_pointer = go_evaluation_function_callback;
+  }
+
+  // Only pass the checkpointing function if checkpointing
+  lbfgsb_checkpoint_function_type checkpoint_function_pointer = NULL;
+  if (checkpoint_interval > 0) {
+    checkpoint_function_pointer = go_checkpoint_function_callback;
   }
 
   // Call the Fortran code to do the minimization
@@ -47,7 +104,8 @@ int lbfgsb_minimize_c
     (
      go_objective_function_callback,
      go_objective_gradient_callback,
-     callback_data,
+     objective_function_gradient_pointer,
+     callback_handle,
      dim,
      bounds_control,
      lower_bounds,
@@ -55,15 +113,52 @@ int lbfgsb_minimize_c
      approximation_size,
      f_tolerance,
      g_tolerance,
+     max_iterations,
+     max_evaluations,
+     max_restarts,
+     ls_f_tolerance,
+     ls_g_tolerance,
+     ls_x_tolerance,
+     max_step,
+     max_ls_evaluations,
      initial_point,
+     initial_memory_size,
+     initial_s,
+     initial_y,
+     initial_theta,
+     real_workspace,
+     int_workspace,
+     char_workspace,
+     resume,
      min_x,
      min_f,
      min_g,
+     min_fallback,
      iters,
      evals,
+     recoveries,
+     termination_reason,
+     min_g_norm,
+     skipped_updates,
+     cauchy_time,
+     subspace_time,
+     line_search_time,
+     final_memory_size,
+     final_s,
+     final_y,
+     final_theta,
      fortran_print_control,
+     fortran_output_unit,
+     fortran_iterate_unit,
      log_function_pointer,
      log_function_callback_data,
+     go_warning_function_callback,
+     callback_handle,
+     evaluation_function_pointer,
+     callback_handle,
+     checkpoint_interval,
+     checkpoint_function_pointer,
+     callback_handle,
      status_message,
      status_message_length
      );
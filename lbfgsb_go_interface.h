@@ -7,9 +7,15 @@
 #ifndef __LBFGSB_GO_INTERFACE_H__
 #define __LBFGSB_GO_INTERFACE_H__
 
+#include <stdint.h>
+
+// The Go package also uses the library API directly
+#include "lbfgsb_c.h"
+
 int lbfgsb_minimize_c
 (
- void *callback_data,
+ uintptr_t callback_handle,
+ int combined_objective,
  int dim,
  int *bounds_control,
  double *lower_bounds,
@@ -17,15 +23,46 @@ int lbfgsb_minimize_c
  int approximation_size,
  double f_tolerance,
  double g_tolerance,
+ int max_iterations,
+ int max_evaluations,
+ int max_restarts,
+ double ls_f_tolerance,
+ double ls_g_tolerance,
+ double ls_x_tolerance,
+ double max_step,
+ int max_ls_evaluations,
  double *initial_point,
+ int initial_memory_size,
+ double *initial_s,
+ double *initial_y,
+ double initial_theta,
+ double *real_workspace,
+ int *int_workspace,
+ char *char_workspace,
+ int resume,
  double *min_x,
  double *min_f,
  double *min_g,
+ int *min_fallback,
  int *iters,
  int *evals,
+ int *recoveries,
+ int *termination_reason,
+ double *min_g_norm,
+ int *skipped_updates,
+ double *cauchy_time,
+ double *subspace_time,
+ double *line_search_time,
+ int *final_memory_size,
+ double *final_s,
+ double *final_y,
+ double *final_theta,
  int fortran_print_control,
+ int fortran_output_unit,
+ int fortran_iterate_unit,
  int do_logging,
- void *log_function_callback_data,
+ int observe_evaluations,
+ int checkpoint_interval,
  char *status_message,
  int status_message_length
  );
@@ -0,0 +1,1863 @@
+// Copyright (c) 2014 Aubrey Barnard.  This is free software.  See
+// LICENSE.txt for details.
+
+// Tests of the Go interface to L-BFGS-B.  Run them with the race
+// detector ('make test').
+
+package lbfgsb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// shiftedSphere is the function sum_i (x_i - i)^2, whose minimum is at
+// x_i = i.
+type shiftedSphere struct{}
+
+func (shiftedSphere) EvaluateFunction(point []float64) float64 {
+	value := 0.0
+	for i, x := range point {
+		value += (x - float64(i)) * (x - float64(i))
+	}
+	return value
+}
+
+func (shiftedSphere) EvaluateGradient(point []float64) []float64 {
+	gradient := make([]float64, len(point))
+	for i, x := range point {
+		gradient[i] = 2 * (x - float64(i))
+	}
+	return gradient
+}
+
+// checkMinimum marks the test failed unless the given minimum is that
+// of the shifted sphere to within the given tolerance.  Does not stop
+// the test, so it may be called from any goroutine.
+func checkMinimum(t *testing.T, minimum PointValueGradient,
+	exitStatus ExitStatus, tolerance float64) {
+
+	t.Helper()
+	if exitStatus.Code != SUCCESS {
+		t.Errorf("Minimization failed: %v", exitStatus)
+		return
+	}
+	for i, x := range minimum.X {
+		if math.Abs(x-float64(i)) > tolerance {
+			t.Errorf("Minimum coordinate %d is %g.  Expected %d.",
+				i, x, i)
+			return
+		}
+	}
+}
+
+// TestConcurrentMinimize minimizes with many goroutines sharing one
+// zero-value solver, which they initialize and use concurrently.
+func TestConcurrentMinimize(t *testing.T) {
+	const dim = 10
+	const workers = 32
+	solver := new(Lbfgsb)
+
+	var wait sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wait.Add(1)
+		go func(w int) {
+			defer wait.Done()
+			initialPoint := make([]float64, dim)
+			for i := range initialPoint {
+				initialPoint[i] = float64(w - i)
+			}
+			minimum, exitStatus := solver.Minimize(
+				shiftedSphere{}, initialPoint)
+			checkMinimum(t, minimum, exitStatus, 1e-4)
+			if exitStatus.Statistics().Iterations <= 0 {
+				t.Errorf("Iterations %d <= 0.  Expected > 0.",
+					exitStatus.Statistics().Iterations)
+			}
+		}(w)
+	}
+	wait.Wait()
+
+	// The solver keeps the statistics of one of the minimizations
+	if solver.OptimizationStatistics().Iterations <= 0 {
+		t.Errorf("Solver statistics not saved")
+	}
+}
+
+// shiftedSphereCombined is the shifted sphere evaluated with its
+// gradient in one call into the optimizer's gradient.
+type shiftedSphereCombined struct {
+	shiftedSphere
+}
+
+func (shiftedSphereCombined) EvaluateFunctionGradient(
+	point, gradient []float64) float64 {
+
+	value := 0.0
+	for i, x := range point {
+		value += (x - float64(i)) * (x - float64(i))
+		gradient[i] = 2 * (x - float64(i))
+	}
+	return value
+}
+
+// TestCallbacks minimizes with every kind of callback so that all the
+// paths between Go and C are exercised (also run under strict cgo
+// checking, 'make test-cgocheck').
+func TestCallbacks(t *testing.T) {
+	const dim = 6
+	for _, objective := range []FunctionWithGradient{
+		shiftedSphere{}, shiftedSphereCombined{}} {
+
+		var iterations, evaluations int
+		var lastX []float64
+		solver := NewLbfgsb(dim).
+			SetLogger(func(info *OptimizationIterationInformation) {
+				iterations++
+				if info.Iteration != iterations {
+					t.Errorf("Iteration %d.  Expected %d.",
+						info.Iteration, iterations)
+				}
+			}).
+			SetStopCondition(
+				func(info *OptimizationIterationInformation) (
+					bool, string) {
+					return false, ""
+				}).
+			SetWarningHandler(func(warning Warning) {}).
+			SetEvaluationObserver(func(info EvaluationInfo) {
+				evaluations++
+				if info.Evaluation != evaluations {
+					t.Errorf("Evaluation %d.  Expected %d.",
+						info.Evaluation, evaluations)
+				}
+				// The point belongs to the optimizer
+				lastX = append(lastX[:0], info.X...)
+			})
+		minimum, exitStatus := solver.Minimize(
+			objective, make([]float64, dim))
+		checkMinimum(t, minimum, exitStatus, 1e-4)
+
+		statistics := exitStatus.Statistics()
+		if iterations != statistics.Iterations {
+			t.Errorf("Logged %d iterations.  Expected %d.",
+				iterations, statistics.Iterations)
+		}
+		if evaluations != statistics.FunctionEvaluations {
+			t.Errorf("Observed %d evaluations.  Expected %d.",
+				evaluations, statistics.FunctionEvaluations)
+		}
+		if len(lastX) != dim {
+			t.Errorf("Observed point has dimensionality %d.  Expected %d.",
+				len(lastX), dim)
+		}
+	}
+}
+
+// TestCallbackPanic checks that a panic in a callback is recovered
+// before it reaches the Fortran code and raised again afterwards.
+func TestCallbackPanic(t *testing.T) {
+	solver := NewLbfgsb(2).SetLogger(
+		func(info *OptimizationIterationInformation) {
+			panic("logger")
+		})
+	defer func() {
+		value := recover()
+		if callbackPanic, ok := value.(*CallbackPanic); !ok ||
+			callbackPanic.Value != "logger" {
+			t.Errorf("Recovered %v.  Expected a *CallbackPanic.", value)
+		}
+	}()
+	solver.Minimize(shiftedSphere{}, []float64{5, 5})
+}
+
+// TestMinimizeContextCanceled checks that a cancellation is reported
+// with its own exit status.
+func TestMinimizeContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, exitStatus := NewLbfgsb(2).MinimizeContext(
+		ctx, shiftedSphere{}, []float64{5, 5})
+	if exitStatus.Code != CANCELED {
+		t.Errorf("Exit status %v.  Expected %v.", exitStatus.Code, CANCELED)
+	}
+	if !errors.Is(exitStatus, context.Canceled) {
+		t.Errorf("Exit status %v does not wrap %v.",
+			exitStatus, context.Canceled)
+	}
+}
+
+// deadlineObjective is rosenbrock, but its evaluation at a given count
+// waits for the deadline of a context to pass, so that an optimization
+// with that deadline stops right after that evaluation.
+type deadlineObjective struct {
+	recordingObjective
+	ctx    context.Context
+	waitAt int
+}
+
+func (deadline *deadlineObjective) EvaluateFunction(
+	point []float64) float64 {
+
+	if len(deadline.values)+1 == deadline.waitAt {
+		<-deadline.ctx.Done()
+	}
+	return deadline.recordingObjective.EvaluateFunction(point)
+}
+
+// TestMinimizeContextDeadline checks that an optimization whose
+// deadline passes while it runs stops before the next evaluation with
+// the best point found so far.
+func TestMinimizeContextDeadline(t *testing.T) {
+	const dim = 4
+	const evaluations = 7
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 10*time.Millisecond)
+	defer cancel()
+	objective := &deadlineObjective{
+		recordingObjective: recordingObjective{objective: rosenbrock{}},
+		ctx:                ctx,
+		waitAt:             evaluations,
+	}
+	minimum, exitStatus := NewLbfgsb(dim).MinimizeContext(
+		ctx, objective, rosenbrockStart(dim))
+	if exitStatus.Code != CANCELED || exitStatus.Reason != CALLBACK_STOP {
+		t.Errorf("Exit status %v (%v).  Expected %v (%v).",
+			exitStatus.Code, exitStatus.Reason, CANCELED, CALLBACK_STOP)
+	}
+	if !errors.Is(exitStatus, context.DeadlineExceeded) ||
+		errors.Is(exitStatus, context.Canceled) {
+		t.Errorf("Exit status %v does not wrap only %v.",
+			exitStatus, context.DeadlineExceeded)
+	}
+	if len(objective.values) != evaluations ||
+		exitStatus.Statistics().FunctionEvaluations != evaluations {
+		t.Errorf("Evaluated %d times and counted %d.  Expected %d.",
+			len(objective.values),
+			exitStatus.Statistics().FunctionEvaluations, evaluations)
+	}
+
+	// The minimum is the best point evaluated
+	best := math.Inf(1)
+	for _, value := range objective.values {
+		best = math.Min(best, value)
+	}
+	if minimum.F != best ||
+		minimum.F != (rosenbrock{}).EvaluateFunction(minimum.X) {
+		t.Errorf("Minimum %g at %v.  Expected the best value %g.",
+			minimum.F, minimum.X, best)
+	}
+}
+
+// evaluationError is an error that carries data, which makes it not
+// comparable.
+type evaluationError struct {
+	point []float64
+}
+
+func (err evaluationError) Error() string {
+	return fmt.Sprintf("Cannot evaluate at %v", err.point)
+}
+
+// TestExitStatusErrors checks the errors that exit statuses wrap and
+// match and how exit statuses compare.
+func TestExitStatusErrors(t *testing.T) {
+	// An objective that fails
+	objective := GeneralObjectiveFunctionErr{
+		Function: func(point []float64) (float64, error) {
+			return 0, evaluationError{append([]float64(nil), point...)}
+		},
+		Gradient: func(point []float64) ([]float64, error) {
+			return nil, errors.New("Gradient evaluated after a failure")
+		},
+	}
+	_, exitStatus := NewLbfgsb(2).MinimizeErr(objective, []float64{5, 5})
+	if exitStatus.Code != FAILURE || exitStatus.Reason != CALLBACK_ERROR {
+		t.Errorf("Exit status %v (%v).  Expected %v (%v).",
+			exitStatus.Code, exitStatus.Reason, FAILURE, CALLBACK_ERROR)
+	}
+	var evalErr evaluationError
+	if !errors.As(exitStatus, &evalErr) || len(evalErr.point) != 2 {
+		t.Errorf("Exit status %v does not wrap the evaluation error.",
+			exitStatus)
+	}
+	if _, ok := errors.Unwrap(exitStatus).(evaluationError); !ok {
+		t.Errorf("Unwrapped %v.  Expected the evaluation error.",
+			errors.Unwrap(exitStatus))
+	}
+	if !errors.Is(exitStatus, ErrCallbackError) ||
+		errors.Is(exitStatus, ErrIterationLimit) {
+		t.Errorf("Exit status %v does not match only %v.",
+			exitStatus, ErrCallbackError)
+	}
+	if exitStatus.AsError() == nil {
+		t.Errorf("Exit status %v is not an error.", exitStatus)
+	}
+	// == compares the cause, which is not comparable, by identity
+	copied := exitStatus
+	if copied != exitStatus || !copied.Equal(exitStatus) {
+		t.Errorf("Copy of exit status %v is not equal.", exitStatus)
+	}
+
+	// A termination reason without an underlying error
+	_, exitStatus = NewLbfgsb(4).
+		SetMaxIterations(1).
+		Minimize(rosenbrock{}, rosenbrockStart(4))
+	if !errors.Is(exitStatus, ErrIterationLimit) {
+		t.Errorf("Exit status %v does not match %v.",
+			exitStatus, ErrIterationLimit)
+	}
+	if errors.Unwrap(exitStatus) != nil {
+		t.Errorf("Unwrapped %v.  Expected nil.", errors.Unwrap(exitStatus))
+	}
+
+	// Outcomes compare with Equal, not with ==, which compares the
+	// statistics by identity
+	limited := func() ExitStatus {
+		_, exitStatus := NewLbfgsb(2).
+			SetMaxIterations(1).
+			Minimize(shiftedSphere{}, []float64{5, 5})
+		return exitStatus
+	}
+	exitStatus = limited()
+	literal := ExitStatus{
+		Code:    WARNING,
+		Reason:  ITERATION_LIMIT,
+		Message: "TOTAL NUMBER OF ITERATIONS REACHED LIMIT",
+	}
+	if !exitStatus.Equal(literal) || exitStatus == literal {
+		t.Errorf("Exit status %v: Equal to %v: %v, ==: %v.  "+
+			"Expected Equal but not ==.", exitStatus, literal,
+			exitStatus.Equal(literal), exitStatus == literal)
+	}
+	if other := limited(); !exitStatus.Equal(other) || exitStatus == other {
+		t.Errorf("Exit statuses of identical runs %v and %v: Equal: %v, "+
+			"==: %v.  Expected Equal but not ==.", exitStatus, other,
+			exitStatus.Equal(other), exitStatus == other)
+	}
+	literal.Fallback = true
+	if exitStatus.Equal(literal) {
+		t.Errorf("Exit status %v is Equal to a fallback.", exitStatus)
+	}
+
+	// Success
+	_, exitStatus = NewLbfgsb(2).Minimize(shiftedSphere{}, []float64{5, 5})
+	if exitStatus.AsError() != nil {
+		t.Errorf("Exit status %v is an error.  Expected nil.", exitStatus)
+	}
+	if !errors.Is(exitStatus, ErrConvergedProjectedGradient) &&
+		!errors.Is(exitStatus, ErrConvergedRelativeReduction) {
+		t.Errorf("Exit status %v does not match a convergence reason.",
+			exitStatus)
+	}
+}
+
+// TestGradientWrongDimensionality checks that gradients that are too
+// short or too long fail the minimization instead of being silently
+// padded with stale components or truncated.
+func TestGradientWrongDimensionality(t *testing.T) {
+	const dim = 3
+	for _, gradientDim := range []int{dim - 1, dim + 1} {
+		gradient := func(point []float64) []float64 {
+			return shiftedSphere{}.EvaluateGradient(
+				make([]float64, gradientDim))
+		}
+		// Both with and without errors
+		minimizations := []func() ExitStatus{
+			func() ExitStatus {
+				_, exitStatus := NewLbfgsb(dim).Minimize(
+					GeneralObjectiveFunction{
+						Function: shiftedSphere{}.EvaluateFunction,
+						Gradient: gradient,
+					}, make([]float64, dim))
+				return exitStatus
+			},
+			func() ExitStatus {
+				_, exitStatus := NewLbfgsb(dim).MinimizeErr(
+					GeneralObjectiveFunctionErr{
+						Function: func(point []float64) (float64, error) {
+							return shiftedSphere{}.EvaluateFunction(point), nil
+						},
+						Gradient: func(point []float64) ([]float64, error) {
+							return gradient(point), nil
+						},
+					}, make([]float64, dim))
+				return exitStatus
+			},
+		}
+		for _, minimize := range minimizations {
+			exitStatus := minimize()
+			if exitStatus.Code != FAILURE ||
+				exitStatus.Reason != CALLBACK_ERROR ||
+				!strings.Contains(exitStatus.Message, "Dimensionality") {
+				t.Errorf("Gradient of %d for %d: Exit status %v.  "+
+					"Expected %v (%v) about the dimensionality.",
+					gradientDim, dim, exitStatus, FAILURE, CALLBACK_ERROR)
+			}
+			if errors.Unwrap(exitStatus) == nil {
+				t.Errorf("Gradient of %d for %d: Exit status %v has "+
+					"no cause.", gradientDim, dim, exitStatus)
+			}
+		}
+	}
+}
+
+// TestTerminationReasons checks the names and sentinel errors of the
+// termination reasons and that optimizations report the reasons they
+// stop for.
+func TestTerminationReasons(t *testing.T) {
+	// Every reason but UNKNOWN_REASON has its own name and error
+	names := map[string]bool{}
+	errs := map[error]bool{}
+	for reason := UNKNOWN_REASON + 1; reason <= UNRECOGNIZED_TASK; reason++ {
+		if reason.String() == "UNKNOWN_REASON" || names[reason.String()] {
+			t.Errorf("Reason %d has name %v.  Expected a name of its own.",
+				uint8(reason), reason)
+		}
+		if reason.Err() == nil || errs[reason.Err()] {
+			t.Errorf("Reason %v has error %v.  Expected an error of its own.",
+				reason, reason.Err())
+		}
+		names[reason.String()] = true
+		errs[reason.Err()] = true
+	}
+	for _, reason := range []TerminationReason{
+		UNKNOWN_REASON, UNRECOGNIZED_TASK + 1} {
+		if reason.String() != "UNKNOWN_REASON" || reason.Err() != nil {
+			t.Errorf("Reason %d has name %v and error %v.  "+
+				"Expected UNKNOWN_REASON and nil.",
+				uint8(reason), reason, reason.Err())
+		}
+	}
+
+	const dim = 4
+	tests := []struct {
+		name   string
+		solver *Lbfgsb
+		code   ExitStatusCode
+		reason TerminationReason
+	}{
+		// The gradient is checked before the reduction
+		{"gradient", NewLbfgsb(dim).
+			SetGTolerance(1e-2).
+			SetFTolerance(1e-300),
+			SUCCESS, CONVERGED_PROJECTED_GRADIENT},
+		{"reduction", NewLbfgsb(dim).
+			SetGTolerance(1e-300).
+			SetFTolerance(1e-3),
+			SUCCESS, CONVERGED_RELATIVE_REDUCTION},
+		{"stop condition", NewLbfgsb(dim).
+			SetStopCondition(
+				func(info *OptimizationIterationInformation) (
+					bool, string) {
+					return info.Iteration >= 2, "Enough"
+				}),
+			WARNING, CALLBACK_STOP},
+		{"bounds", NewLbfgsb(dim).
+			SetBoundsAll(1, -1),
+			USAGE_ERROR, INVALID_INPUT},
+	}
+	for _, test := range tests {
+		_, exitStatus := test.solver.Minimize(
+			rosenbrock{}, rosenbrockStart(dim))
+		if exitStatus.Code != test.code ||
+			exitStatus.Reason != test.reason {
+			t.Errorf("%s: Exit status %v (%v).  Expected %v (%v).",
+				test.name, exitStatus.Code, exitStatus.Reason,
+				test.code, test.reason)
+		}
+		if !errors.Is(exitStatus, test.reason.Err()) {
+			t.Errorf("%s: Exit status %v does not match %v.",
+				test.name, exitStatus, test.reason.Err())
+		}
+		if test.reason == CALLBACK_STOP {
+			if exitStatus.Message != "Enough" ||
+				exitStatus.Statistics().Iterations != 2 {
+				t.Errorf("%s: Stopped after %d iterations with message "+
+					"%q.  Expected 2 and \"Enough\".", test.name,
+					exitStatus.Statistics().Iterations, exitStatus.Message)
+			}
+		}
+	}
+}
+
+// TestIterationInformation checks the information about each
+// iteration against the iterates and the statistics.
+func TestIterationInformation(t *testing.T) {
+	const dim = 4
+	const gTolerance = 1e-5
+	initialPoint := rosenbrockStart(dim)
+	previousX := append([]float64(nil), initialPoint...)
+	previousF := rosenbrock{}.EvaluateFunction(initialPoint)
+	var last OptimizationIterationInformation
+	fEvals, segments := 1, 0
+	solver := NewLbfgsb(dim).
+		SetGTolerance(gTolerance).
+		SetLogger(func(info *OptimizationIterationInformation) {
+			fEvals += info.FEvals
+			segments += info.Segments
+			if info.FEvalsTotal != fEvals ||
+				info.GEvalsTotal != info.FEvalsTotal ||
+				info.GEvals != info.FEvals {
+				t.Errorf("Iteration %d: Evaluations %d (%d) of %d (%d).  "+
+					"Expected %d (%d) of %d (%d).", info.Iteration,
+					info.FEvals, info.GEvals, info.FEvalsTotal,
+					info.GEvalsTotal, info.FEvals, info.FEvals,
+					fEvals, fEvals)
+			}
+			if info.SegmentsTotal != segments {
+				t.Errorf("Iteration %d: Segments total %d.  Expected %d.",
+					info.Iteration, info.SegmentsTotal, segments)
+			}
+
+			// Step and convergence measures
+			var step, gNorm float64
+			for i := range info.X {
+				step += (info.X[i] - previousX[i]) *
+					(info.X[i] - previousX[i])
+				gNorm = math.Max(gNorm, math.Abs(info.G[i]))
+			}
+			step = math.Sqrt(step)
+			if math.Abs(info.StepLength-step) > 1e-8*math.Max(step, 1) {
+				t.Errorf("Iteration %d: Step length %g.  Expected %g.",
+					info.Iteration, info.StepLength, step)
+			}
+			if info.GNorm != gNorm || info.GNormBound != gTolerance {
+				t.Errorf("Iteration %d: Gradient norm %g (bound %g).  "+
+					"Expected %g (bound %g).", info.Iteration,
+					info.GNorm, info.GNormBound, gNorm, gTolerance)
+			}
+			fDelta := math.Abs(previousF-info.F) /
+				math.Max(math.Max(math.Abs(previousF), math.Abs(info.F)), 1)
+			if math.Abs(info.FDelta-fDelta) > 1e-12 ||
+				math.Abs(info.FDeltaBound-1e-6) > 1e-12 {
+				t.Errorf("Iteration %d: Relative reduction %g (bound %g).  "+
+					"Expected %g (bound %g).", info.Iteration,
+					info.FDelta, info.FDeltaBound, fDelta, 1e-6)
+			}
+
+			// Internals.  Without bounds all the variables are free.
+			if info.Theta <= 0 || info.DirectionNorm <= 0 ||
+				info.InitialSlope >= 0 {
+				t.Errorf("Iteration %d: Theta %g, direction norm %g, "+
+					"initial slope %g.  Expected > 0, > 0, < 0.",
+					info.Iteration, info.Theta, info.DirectionNorm,
+					info.InitialSlope)
+			}
+			if info.FreeVariables != dim || info.ActiveVariables != 0 ||
+				info.SubspaceTruncated {
+				t.Errorf("Iteration %d: %d free and %d active variables, "+
+					"truncated %v.  Expected %d, 0, false.",
+					info.Iteration, info.FreeVariables,
+					info.ActiveVariables, info.SubspaceTruncated, dim)
+			}
+			if info.SkippedUpdates < last.SkippedUpdates {
+				t.Errorf("Iteration %d: Skipped updates %d < %d.",
+					info.Iteration, info.SkippedUpdates,
+					last.SkippedUpdates)
+			}
+
+			previousX = append(previousX[:0], info.X...)
+			previousF = info.F
+			last = *info
+		})
+	_, exitStatus := solver.Minimize(rosenbrock{}, initialPoint)
+	if exitStatus.Code != SUCCESS {
+		t.Fatalf("Minimization failed: %v", exitStatus)
+	}
+	statistics := exitStatus.Statistics()
+	if last.Iteration != statistics.Iterations ||
+		last.FEvalsTotal != statistics.FunctionEvaluations ||
+		last.SkippedUpdates != statistics.SkippedUpdates {
+		t.Errorf("Last iteration %d with %d evaluations and %d skipped "+
+			"updates.  Expected %d, %d, %d.", last.Iteration,
+			last.FEvalsTotal, last.SkippedUpdates, statistics.Iterations,
+			statistics.FunctionEvaluations, statistics.SkippedUpdates)
+	}
+}
+
+// rosenbrock is the Rosenbrock function generalized to any even
+// dimensionality, whose minimum is at x_i = 1.  It takes many
+// iterations to minimize.
+type rosenbrock struct{}
+
+func (rosenbrock) EvaluateFunction(point []float64) float64 {
+	value := 0.0
+	for i := 0; i+1 < len(point); i += 2 {
+		a := point[i+1] - point[i]*point[i]
+		b := 1 - point[i]
+		value += 100*a*a + b*b
+	}
+	return value
+}
+
+func (rosenbrock) EvaluateGradient(point []float64) []float64 {
+	gradient := make([]float64, len(point))
+	for i := 0; i+1 < len(point); i += 2 {
+		a := point[i+1] - point[i]*point[i]
+		gradient[i] = -400*a*point[i] - 2*(1-point[i])
+		gradient[i+1] = 200 * a
+	}
+	return gradient
+}
+
+// rosenbrockStart is a point from which minimizing rosenbrock takes
+// dozens of iterations.
+func rosenbrockStart(dim int) []float64 {
+	point := make([]float64, dim)
+	for i := range point {
+		point[i] = -1.2
+		if i%2 == 1 {
+			point[i] = 1
+		}
+	}
+	return point
+}
+
+// TestCheckpointResume interrupts an optimization with an iteration
+// limit, resumes it from its checkpoint, and checks that the result is
+// that of the uninterrupted optimization.
+func TestCheckpointResume(t *testing.T) {
+	const dim = 4
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	_, exitStatus := NewLbfgsb(dim).
+		SetCheckpoint(path, 1).
+		SetMaxIterations(5).
+		Minimize(rosenbrock{}, rosenbrockStart(dim))
+	if exitStatus.Reason != ITERATION_LIMIT {
+		t.Fatalf("Interrupted by %v.  Expected %v.",
+			exitStatus.Reason, ITERATION_LIMIT)
+	}
+
+	resumed, resumedStatus := NewLbfgsb(dim).Resume(path, rosenbrock{})
+	expected, expectedStatus := NewLbfgsb(dim).Minimize(
+		rosenbrock{}, rosenbrockStart(dim))
+	if resumedStatus.Code != SUCCESS {
+		t.Fatalf("Resumed minimization failed: %v", resumedStatus)
+	}
+	for i := range expected.X {
+		if resumed.X[i] != expected.X[i] {
+			t.Errorf("Resumed minimum at %v.  Expected %v.",
+				resumed.X, expected.X)
+			break
+		}
+	}
+	if resumedStatus.Statistics().Iterations !=
+		expectedStatus.Statistics().Iterations {
+		t.Errorf("Resumed minimization took %d iterations.  "+
+			"Expected %d.", resumedStatus.Statistics().Iterations,
+			expectedStatus.Statistics().Iterations)
+	}
+
+	// The history before the checkpoint (skipped gradients, warnings,
+	// and restarts) is kept too.  Interrupt after the restart.
+	solver := func() *Lbfgsb {
+		return NewLbfgsb(dim).SetRestartPolicy(1)
+	}
+	expected, expectedStatus = solver().Minimize(
+		&thawingObjective{freezeAt: 10}, rosenbrockStart(dim))
+	expectedStatistics := expectedStatus.Statistics()
+	if expectedStatus.Code != SUCCESS || expectedStatistics.Restarts != 1 {
+		t.Fatalf("Uninterrupted minimization: Exit status %v with %d "+
+			"restarts.  Expected %v with 1.", expectedStatus,
+			expectedStatistics.Restarts, SUCCESS)
+	}
+	objective := &thawingObjective{freezeAt: 10}
+	_, exitStatus = solver().
+		SetCheckpoint(path, 1).
+		SetMaxIterations(expectedStatistics.RestartHistory[0].Iteration+2).
+		Minimize(objective, rosenbrockStart(dim))
+	if exitStatus.Reason != ITERATION_LIMIT ||
+		exitStatus.Statistics().Restarts != 1 {
+		t.Fatalf("Interrupted by %v after %d restarts.  Expected %v "+
+			"after 1.", exitStatus.Reason,
+			exitStatus.Statistics().Restarts, ITERATION_LIMIT)
+	}
+	resumed, resumedStatus = solver().Resume(path, objective)
+	resumedStatistics := resumedStatus.Statistics()
+	if resumedStatus.Code != SUCCESS ||
+		!equalPoints(resumed.X, expected.X) {
+		t.Fatalf("Resumed minimization: Exit status %v, minimum at %v.  "+
+			"Expected %v at %v.", resumedStatus, resumed.X,
+			SUCCESS, expected.X)
+	}
+	if resumedStatistics.Iterations != expectedStatistics.Iterations ||
+		resumedStatistics.FunctionEvaluations !=
+			expectedStatistics.FunctionEvaluations ||
+		resumedStatistics.GradientEvaluations !=
+			expectedStatistics.GradientEvaluations ||
+		resumedStatistics.Restarts != expectedStatistics.Restarts {
+		t.Errorf("Resumed minimization took %d iterations, %d function "+
+			"and %d gradient evaluations, and %d restarts.  Expected "+
+			"%d, %d, %d, and %d.", resumedStatistics.Iterations,
+			resumedStatistics.FunctionEvaluations,
+			resumedStatistics.GradientEvaluations,
+			resumedStatistics.Restarts, expectedStatistics.Iterations,
+			expectedStatistics.FunctionEvaluations,
+			expectedStatistics.GradientEvaluations,
+			expectedStatistics.Restarts)
+	}
+	if expectedStatistics.GradientEvaluations >=
+		expectedStatistics.FunctionEvaluations {
+		t.Errorf("No gradients skipped.  Expected some.")
+	}
+	if len(resumedStatistics.RestartHistory) != 1 ||
+		resumedStatistics.RestartHistory[0] !=
+			expectedStatistics.RestartHistory[0] {
+		t.Errorf("Resumed restart history %v.  Expected %v.",
+			resumedStatistics.RestartHistory,
+			expectedStatistics.RestartHistory)
+	}
+	if fmt.Sprint(resumedStatus.Warnings()) !=
+		fmt.Sprint(expectedStatus.Warnings()) {
+		t.Errorf("Resumed warnings %v.  Expected %v.",
+			resumedStatus.Warnings(), expectedStatus.Warnings())
+	}
+}
+
+// thawingObjective is rosenbrock until it has been evaluated a number
+// of times and afterwards is NaN at every point it has not already been
+// evaluated at, until it is evaluated again at such a point.  Every
+// line search fails meanwhile, so an optimization that is allowed to
+// restart restarts from its iterate, which thaws the objective, and
+// then continues normally.
+type thawingObjective struct {
+	freezeAt    int
+	evaluations int
+	frozen      bool
+	points      [][]float64
+}
+
+func (thawing *thawingObjective) EvaluateFunction(point []float64) float64 {
+	thawing.evaluations++
+	if thawing.evaluations == thawing.freezeAt {
+		thawing.frozen = true
+	}
+	if thawing.frozen {
+		for _, evaluated := range thawing.points {
+			if equalPoints(point, evaluated) {
+				thawing.frozen = false
+			}
+		}
+	}
+	thawing.points = append(thawing.points, append([]float64(nil), point...))
+	if thawing.frozen {
+		return math.NaN()
+	}
+	return rosenbrock{}.EvaluateFunction(point)
+}
+
+func (thawing *thawingObjective) EvaluateGradient(point []float64) []float64 {
+	return rosenbrock{}.EvaluateGradient(point)
+}
+
+// TestCheckpointInvalid checks that resuming from files that are not
+// valid checkpoints of the same configuration is a usage error.
+func TestCheckpointInvalid(t *testing.T) {
+	const dim = 4
+	dir := t.TempDir()
+	path := filepath.Join(dir, "checkpoint")
+	NewLbfgsb(dim).
+		SetCheckpoint(path, 1).
+		SetMaxIterations(2).
+		Minimize(rosenbrock{}, rosenbrockStart(dim))
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modify := func(modify func(contents []byte) []byte) []byte {
+		modified := append([]byte(nil), contents...)
+		return modify(modified)
+	}
+	withChecksum := func(contents []byte) []byte {
+		body := contents[:len(contents)-4]
+		binary.LittleEndian.PutUint32(contents[len(body):],
+			crc32.ChecksumIEEE(body))
+		return contents
+	}
+
+	// Each case is the contents of the file, nil if there is none, and
+	// the solver to resume with
+	cases := []struct {
+		name     string
+		contents []byte
+		solver   *Lbfgsb
+	}{
+		{"missing", nil, NewLbfgsb(dim)},
+		{"not a checkpoint", []byte("not a checkpoint"), NewLbfgsb(dim)},
+		{"truncated", contents[:len(contents)/2], NewLbfgsb(dim)},
+		{"corrupt", modify(func(contents []byte) []byte {
+			contents[len(contents)/2] ^= 0xff
+			return contents
+		}), NewLbfgsb(dim)},
+		{"wrong version", modify(func(contents []byte) []byte {
+			binary.LittleEndian.PutUint32(
+				contents[len(checkpointMagic):], checkpointVersion+1)
+			return withChecksum(contents)
+		}), NewLbfgsb(dim)},
+		{"extra data", modify(func(contents []byte) []byte {
+			body := contents[:len(contents)-4]
+			return withChecksum(append(body, make([]byte, 12)...))
+		}), NewLbfgsb(dim)},
+		{"different configuration", contents,
+			NewLbfgsb(dim).SetBoundsAll(-2, 2)},
+	}
+	for _, c := range cases {
+		casePath := filepath.Join(dir, "case")
+		os.Remove(casePath)
+		if c.contents != nil {
+			if err := os.WriteFile(casePath, c.contents, 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, exitStatus := c.solver.Resume(casePath, rosenbrock{})
+		if exitStatus.Code != USAGE_ERROR {
+			t.Errorf("%s: Exit status %v.  Expected %v.",
+				c.name, exitStatus.Code, USAGE_ERROR)
+		}
+	}
+}
+
+// TestSetLineSearchParameters checks that the line search setters
+// reject invalid values and that Init keeps valid ones, zero included.
+func TestSetLineSearchParameters(t *testing.T) {
+	invalid := []struct {
+		name string
+		set  func(solver *Lbfgsb)
+	}{
+		{"F tolerance 0", func(solver *Lbfgsb) {
+			solver.SetLineSearchTolerances(0, 0.9, 0.1)
+		}},
+		{"F tolerance > G tolerance", func(solver *Lbfgsb) {
+			solver.SetLineSearchTolerances(0.5, 0.1, 0.1)
+		}},
+		{"G tolerance 1", func(solver *Lbfgsb) {
+			solver.SetLineSearchTolerances(1e-3, 1, 0.1)
+		}},
+		{"X tolerance < 0", func(solver *Lbfgsb) {
+			solver.SetLineSearchTolerances(1e-3, 0.9, -1)
+		}},
+		{"NaN X tolerance", func(solver *Lbfgsb) {
+			solver.SetLineSearchTolerances(1e-3, 0.9, math.NaN())
+		}},
+		{"max step < 0", func(solver *Lbfgsb) {
+			solver.SetMaxStep(-1)
+		}},
+		{"NaN max step", func(solver *Lbfgsb) {
+			solver.SetMaxStep(math.NaN())
+		}},
+		{"max line search evaluations 0", func(solver *Lbfgsb) {
+			solver.SetMaxLineSearchEvaluations(0)
+		}},
+	}
+	for _, c := range invalid {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: No panic.  Expected a panic.", c.name)
+				}
+			}()
+			c.set(new(Lbfgsb))
+		}()
+	}
+
+	// Set before Init, which must not replace them with the defaults
+	var solver Lbfgsb
+	solver.SetLineSearchTolerances(1e-4, 0.5, 0).
+		SetMaxLineSearchEvaluations(3).
+		Init(2)
+	if solver.lineSearchFTolerance != 1e-4 ||
+		solver.lineSearchGTolerance != 0.5 ||
+		solver.lineSearchXTolerance != 0 {
+		t.Errorf("Line search tolerances %g, %g, %g.  Expected 1e-4, 0.5, 0.",
+			solver.lineSearchFTolerance, solver.lineSearchGTolerance,
+			solver.lineSearchXTolerance)
+	}
+	if solver.maxLineSearchEvaluations != 3 {
+		t.Errorf("Max line search evaluations %d.  Expected 3.",
+			solver.maxLineSearchEvaluations)
+	}
+	minimum, exitStatus := solver.Minimize(
+		shiftedSphere{}, make([]float64, 2))
+	checkMinimum(t, minimum, exitStatus, 1e-4)
+}
+
+// recordingObjective records the values of the objective it wraps.
+type recordingObjective struct {
+	objective FunctionWithGradient
+	values    []float64
+}
+
+func (recording *recordingObjective) EvaluateFunction(
+	point []float64) float64 {
+
+	value := recording.objective.EvaluateFunction(point)
+	recording.values = append(recording.values, value)
+	return value
+}
+
+func (recording *recordingObjective) EvaluateGradient(
+	point []float64) []float64 {
+
+	return recording.objective.EvaluateGradient(point)
+}
+
+// TestIterationLimit checks that the optimization stops after exactly
+// the maximum number of iterations.
+func TestIterationLimit(t *testing.T) {
+	const dim = 4
+	for _, maxIterations := range []int{1, 2, 5} {
+		_, exitStatus := NewLbfgsb(dim).
+			SetMaxIterations(maxIterations).
+			Minimize(rosenbrock{}, rosenbrockStart(dim))
+		if exitStatus.Code != WARNING ||
+			exitStatus.Reason != ITERATION_LIMIT {
+			t.Errorf("Exit status %v (%v).  Expected %v (%v).",
+				exitStatus.Code, exitStatus.Reason,
+				WARNING, ITERATION_LIMIT)
+		}
+		if exitStatus.Statistics().Iterations != maxIterations {
+			t.Errorf("Stopped after %d iterations.  Expected %d.",
+				exitStatus.Statistics().Iterations, maxIterations)
+		}
+	}
+}
+
+// TestEvaluationLimit checks that the optimization never evaluates
+// more than the maximum number of times, even in the middle of a line
+// search, and that it returns the best point evaluated.
+func TestEvaluationLimit(t *testing.T) {
+	const dim = 4
+	for maxEvaluations := 1; maxEvaluations <= 12; maxEvaluations++ {
+		objective := &recordingObjective{objective: rosenbrock{}}
+		minimum, exitStatus := NewLbfgsb(dim).
+			SetMaxEvaluations(maxEvaluations).
+			Minimize(objective, rosenbrockStart(dim))
+		if exitStatus.Code != WARNING ||
+			exitStatus.Reason != EVALUATION_LIMIT {
+			t.Errorf("%d evaluations: Exit status %v (%v).  "+
+				"Expected %v (%v).", maxEvaluations,
+				exitStatus.Code, exitStatus.Reason,
+				WARNING, EVALUATION_LIMIT)
+		}
+		if len(objective.values) != maxEvaluations ||
+			exitStatus.Statistics().FunctionEvaluations != maxEvaluations {
+			t.Errorf("%d evaluations: Evaluated %d times and counted %d.  "+
+				"Expected %d.", maxEvaluations, len(objective.values),
+				exitStatus.Statistics().FunctionEvaluations, maxEvaluations)
+		}
+		best := math.Inf(1)
+		for _, value := range objective.values {
+			best = math.Min(best, value)
+		}
+		if minimum.F != best {
+			t.Errorf("%d evaluations: Minimum %g.  Expected %g.",
+				maxEvaluations, minimum.F, best)
+		}
+	}
+}
+
+// TestFallback checks when the minimum is the best point evaluated
+// rather than the most recent iterate.
+func TestFallback(t *testing.T) {
+	// Upon convergence the minimum is the final iterate
+	_, exitStatus := NewLbfgsb(2).Minimize(shiftedSphere{}, []float64{5, 5})
+	if exitStatus.Code != SUCCESS || exitStatus.Fallback {
+		t.Errorf("Converged: Exit status %v, fallback %v.  "+
+			"Expected %v, no fallback.", exitStatus, exitStatus.Fallback,
+			SUCCESS)
+	}
+
+	// The first trial point of the first line search on a descending
+	// line is lower than the initial point but its slope is too steep
+	// to end the line search, so stopping there leaves the initial
+	// point as the iterate
+	line := GeneralObjectiveFunction{
+		Function: func(point []float64) float64 { return -point[0] },
+		Gradient: func(point []float64) []float64 { return []float64{-1} },
+	}
+	minimum, exitStatus := NewLbfgsb(1).
+		SetMaxEvaluations(2).
+		Minimize(line, []float64{0})
+	if exitStatus.Reason != EVALUATION_LIMIT || !exitStatus.Fallback {
+		t.Errorf("Line search stopped: Exit status %v (%v), fallback "+
+			"%v.  Expected %v, fallback.", exitStatus, exitStatus.Reason,
+			exitStatus.Fallback, EVALUATION_LIMIT)
+	}
+	if !(minimum.X[0] > 0 && minimum.F == -minimum.X[0]) {
+		t.Errorf("Line search stopped: Minimum %g at %v.  Expected "+
+			"the trial point beyond 0.", minimum.F, minimum.X)
+	}
+
+	// Nothing finite is evaluated, so the minimum is the initial point
+	// without a value
+	nan := GeneralObjectiveFunction{
+		Function: func(point []float64) float64 { return math.NaN() },
+		Gradient: shiftedSphere{}.EvaluateGradient,
+	}
+	minimum, exitStatus = NewLbfgsb(2).Minimize(nan, []float64{3, 4})
+	if exitStatus.Code != USAGE_ERROR || !exitStatus.Fallback {
+		t.Errorf("Not finite: Exit status %v, fallback %v.  "+
+			"Expected %v, fallback.", exitStatus, exitStatus.Fallback,
+			USAGE_ERROR)
+	}
+	if !equalPoints(minimum.X, []float64{3, 4}) || !math.IsNaN(minimum.F) {
+		t.Errorf("Not finite: Minimum %g at %v.  Expected NaN at "+
+			"the initial point.", minimum.F, minimum.X)
+	}
+}
+
+// freezingObjective is the shifted sphere until it has been evaluated
+// a number of times and afterwards is NaN at every point it has not
+// already been evaluated at.  Every line search after that fails, so
+// an optimization restarts (if allowed) from the iterate it reached
+// and then fails for good because it cannot make progress.
+type freezingObjective struct {
+	freezeAfter int
+	points      [][]float64
+}
+
+func (frozen *freezingObjective) EvaluateFunction(point []float64) float64 {
+	for _, evaluated := range frozen.points {
+		if equalPoints(point, evaluated) {
+			return shiftedSphere{}.EvaluateFunction(point)
+		}
+	}
+	if len(frozen.points) >= frozen.freezeAfter {
+		return math.NaN()
+	}
+	frozen.points = append(frozen.points, append([]float64(nil), point...))
+	return shiftedSphere{}.EvaluateFunction(point)
+}
+
+func (frozen *freezingObjective) EvaluateGradient(point []float64) []float64 {
+	return shiftedSphere{}.EvaluateGradient(point)
+}
+
+// equalPoints returns whether the given points are exactly equal.
+func equalPoints(point1, point2 []float64) bool {
+	if len(point1) != len(point2) {
+		return false
+	}
+	for i := range point1 {
+		if point1[i] != point2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestRestart forces an abnormal line search after some progress and
+// checks the restart and its statistics.
+func TestRestart(t *testing.T) {
+	const dim = 4
+	minimum, exitStatus := NewLbfgsb(dim).
+		SetRestartPolicy(2).
+		SetMaxLineSearchEvaluations(3).
+		Minimize(&freezingObjective{freezeAfter: 3}, make([]float64, dim))
+	if exitStatus.Code != APPROXIMATE ||
+		exitStatus.Reason != ABNORMAL_LINE_SEARCH {
+		t.Fatalf("Exit status %v (%v).  Expected %v (%v).",
+			exitStatus.Code, exitStatus.Reason,
+			APPROXIMATE, ABNORMAL_LINE_SEARCH)
+	}
+
+	// The restart makes no progress, so there is exactly one, from the
+	// point that is the minimum
+	statistics := exitStatus.Statistics()
+	if statistics.Restarts != 1 || len(statistics.RestartHistory) != 1 {
+		t.Fatalf("%d restarts with history %v.  Expected 1.",
+			statistics.Restarts, statistics.RestartHistory)
+	}
+	restart := statistics.RestartHistory[0]
+	if restart.Iteration < 1 || restart.Iteration > statistics.Iterations {
+		t.Errorf("Restart at iteration %d.  Expected in [1, %d].",
+			restart.Iteration, statistics.Iterations)
+	}
+	if restart.Evaluations < 3 ||
+		restart.Evaluations > statistics.FunctionEvaluations {
+		t.Errorf("Restart after %d evaluations.  Expected in [3, %d].",
+			restart.Evaluations, statistics.FunctionEvaluations)
+	}
+	if restart.F != minimum.F || restart.GNorm != statistics.FinalGNorm {
+		t.Errorf("Restart at F: %g, GNorm: %g.  Expected F: %g, GNorm: %g.",
+			restart.F, restart.GNorm, minimum.F, statistics.FinalGNorm)
+	}
+	var warned bool
+	for _, warning := range exitStatus.Warnings() {
+		if warning.Reason == ABNORMAL_LINE_SEARCH {
+			warned = warning.Iteration == restart.Iteration
+		}
+	}
+	if !warned {
+		t.Errorf("Warnings %v.  Expected the restart at iteration %d.",
+			exitStatus.Warnings(), restart.Iteration)
+	}
+
+	// With both bounds on every variable, a restart would repeat the
+	// line search that failed, so there is none
+	_, exitStatus = NewLbfgsb(dim).
+		SetRestartPolicy(2).
+		SetMaxLineSearchEvaluations(3).
+		SetBoundsAll(-10, 10).
+		Minimize(&freezingObjective{freezeAfter: 3}, make([]float64, dim))
+	if exitStatus.Reason != ABNORMAL_LINE_SEARCH ||
+		exitStatus.Statistics().Restarts != 0 {
+		t.Errorf("Bounded: Exit status %v with %d restarts.  "+
+			"Expected %v with none.", exitStatus,
+			exitStatus.Statistics().Restarts, ABNORMAL_LINE_SEARCH)
+	}
+
+	// A session restarts the same way
+	objective := &freezingObjective{freezeAfter: 3}
+	session := NewLbfgsb(dim).
+		SetRestartPolicy(2).
+		SetMaxLineSearchEvaluations(3).
+		NewSession(make([]float64, dim))
+	for request := session.Next(); request.Kind != DONE; request = session.Next() {
+		if request.Kind == EVALUATE {
+			session.Provide(objective.EvaluateFunction(request.X),
+				objective.EvaluateGradient(request.X))
+		}
+	}
+	_, sessionStatus := session.Result()
+	sessionHistory := sessionStatus.Statistics().RestartHistory
+	if len(sessionHistory) != 1 || sessionHistory[0] != restart {
+		t.Errorf("Session restart history %v.  Expected %v.",
+			sessionHistory, statistics.RestartHistory)
+	}
+}
+
+// slowObjective is an objective that takes at least a millisecond to
+// evaluate.
+type slowObjective struct {
+	FunctionWithGradient
+}
+
+func (slow slowObjective) EvaluateFunction(point []float64) float64 {
+	time.Sleep(time.Millisecond)
+	return slow.FunctionWithGradient.EvaluateFunction(point)
+}
+
+// TestEvaluationObserver checks the information about each evaluation
+// against the objective and the iterates, including the evaluations of
+// a restart.
+func TestEvaluationObserver(t *testing.T) {
+	const dim = 4
+	initialPoint := rosenbrockStart(dim)
+	iterate := append([]float64(nil), initialPoint...)
+	var observed []EvaluationInfo
+	objective := &recordingObjective{objective: rosenbrock{}}
+	_, exitStatus := NewLbfgsb(dim).
+		SetEvaluationObserver(func(info EvaluationInfo) {
+			// The line search steps from the iterate
+			var step float64
+			for i := range info.X {
+				step += (info.X[i] - iterate[i]) * (info.X[i] - iterate[i])
+			}
+			step = math.Sqrt(step)
+			if math.Abs(info.StepLength-step) > 1e-8*math.Max(step, 1) {
+				t.Errorf("Evaluation %d: Step length %g.  Expected %g.",
+					info.Evaluation, info.StepLength, step)
+			}
+			info.X = append([]float64(nil), info.X...)
+			info.G = append([]float64(nil), info.G...)
+			observed = append(observed, info)
+		}).
+		SetLogger(func(info *OptimizationIterationInformation) {
+			// The iterate is the point evaluated last
+			last := observed[len(observed)-1]
+			if !equalPoints(info.X, last.X) ||
+				last.Iteration != info.Iteration-1 {
+				t.Errorf("Iteration %d: Last evaluation %v at %v.  "+
+					"Expected at %v in iteration %d.", info.Iteration,
+					last, last.X, info.X, info.Iteration-1)
+			}
+			iterate = append(iterate[:0], info.X...)
+		}).
+		Minimize(slowObjective{objective}, initialPoint)
+	if exitStatus.Code != SUCCESS {
+		t.Fatalf("Minimization failed: %v", exitStatus)
+	}
+	if len(observed) != exitStatus.Statistics().FunctionEvaluations {
+		t.Fatalf("Observed %d evaluations.  Expected %d.",
+			len(observed), exitStatus.Statistics().FunctionEvaluations)
+	}
+	for i, info := range observed {
+		phase := LINE_SEARCH_PHASE
+		if i == 0 {
+			phase = START_PHASE
+		}
+		if info.Evaluation != i+1 || info.Phase != phase ||
+			(phase == START_PHASE) != (info.StepLength == 0) {
+			t.Errorf("Evaluation %d: Number %d, phase %v, step %g.  "+
+				"Expected %d, %v, step > 0 only in the line search.",
+				i+1, info.Evaluation, info.Phase, info.StepLength,
+				i+1, phase)
+		}
+		if i == 0 && (!equalPoints(info.X, initialPoint) ||
+			info.Iteration != 0) {
+			t.Errorf("First evaluation at %v in iteration %d.  "+
+				"Expected at %v in iteration 0.", info.X, info.Iteration,
+				initialPoint)
+		}
+		if i > 0 && info.Iteration < observed[i-1].Iteration {
+			t.Errorf("Evaluation %d: Iteration %d < %d.", i+1,
+				info.Iteration, observed[i-1].Iteration)
+		}
+		var gNorm float64
+		for _, g := range info.G {
+			gNorm = math.Max(gNorm, math.Abs(g))
+		}
+		if info.F != objective.values[i] ||
+			!equalPoints(info.G, rosenbrock{}.EvaluateGradient(info.X)) ||
+			info.GNorm != gNorm {
+			t.Errorf("Evaluation %d: F %g, G %v, GNorm %g.  "+
+				"Expected %g, the gradient at %v, %g.", i+1, info.F,
+				info.G, info.GNorm, objective.values[i], info.X, gNorm)
+		}
+		if info.Elapsed < time.Millisecond {
+			t.Errorf("Evaluation %d: Elapsed %v.  Expected >= %v.",
+				i+1, info.Elapsed, time.Millisecond)
+		}
+	}
+
+	// A restart evaluates the iterate it restarts from.  The gradient
+	// is not evaluated where the value is NaN.
+	var restartEvaluations []EvaluationInfo
+	_, exitStatus = NewLbfgsb(dim).
+		SetRestartPolicy(2).
+		SetMaxLineSearchEvaluations(3).
+		SetEvaluationObserver(func(info EvaluationInfo) {
+			if info.Phase == RESTART_PHASE {
+				restartEvaluations = append(restartEvaluations, info)
+			}
+			if math.IsNaN(info.F) && !math.IsNaN(info.GNorm) {
+				t.Errorf("Evaluation %d: GNorm %g where F is NaN.  "+
+					"Expected NaN.", info.Evaluation, info.GNorm)
+			}
+		}).
+		Minimize(&freezingObjective{freezeAfter: 3}, make([]float64, dim))
+	history := exitStatus.Statistics().RestartHistory
+	if len(history) != 1 || len(restartEvaluations) != 1 {
+		t.Fatalf("Observed %d restart evaluations with history %v.  "+
+			"Expected 1.", len(restartEvaluations), history)
+	}
+	restart, info := history[0], restartEvaluations[0]
+	if info.Iteration != restart.Iteration || info.F != restart.F ||
+		info.Evaluation <= restart.Evaluations || info.StepLength != 0 {
+		t.Errorf("Restart evaluation %v.  Expected iteration %d, F %g, "+
+			"after evaluation %d, step 0.", info, restart.Iteration,
+			restart.F, restart.Evaluations)
+	}
+}
+
+// narrowSphere is the function sum_i (x_i - 0.1 * i)^2 on the domain
+// where no coordinate exceeds its minimum by more than 0.1 and NaN
+// elsewhere.  The first step of a minimization from the origin has
+// length 1, which is outside the domain.
+type narrowSphere struct{}
+
+func (narrowSphere) inDomain(point []float64) bool {
+	for i, x := range point {
+		if x-0.1*float64(i) > 0.1 {
+			return false
+		}
+	}
+	return true
+}
+
+func (sphere narrowSphere) EvaluateFunction(point []float64) float64 {
+	if !sphere.inDomain(point) {
+		return math.NaN()
+	}
+	value := 0.0
+	for i, x := range point {
+		value += (x - 0.1*float64(i)) * (x - 0.1*float64(i))
+	}
+	return value
+}
+
+func (narrowSphere) EvaluateGradient(point []float64) []float64 {
+	gradient := make([]float64, len(point))
+	for i, x := range point {
+		gradient[i] = 2 * (x - 0.1*float64(i))
+	}
+	return gradient
+}
+
+// TestDomainRecovery minimizes an objective that is only defined near
+// its minimum, so that the first line search steps outside its domain,
+// and checks that the optimization recovers whether the objective
+// signals that with NaN or with ErrOutsideDomain.
+func TestDomainRecovery(t *testing.T) {
+	const dim = 6
+	nanObjective := narrowSphere{}
+	errObjective := GeneralObjectiveFunctionErr{
+		Function: func(point []float64) (float64, error) {
+			if !nanObjective.inDomain(point) {
+				return 0, fmt.Errorf("At %v: %w", point, ErrOutsideDomain)
+			}
+			return nanObjective.EvaluateFunction(point), nil
+		},
+		Gradient: func(point []float64) ([]float64, error) {
+			if !nanObjective.inDomain(point) {
+				return nil, ErrOutsideDomain
+			}
+			return nanObjective.EvaluateGradient(point), nil
+		},
+	}
+
+	for _, run := range []struct {
+		name     string
+		minimize func(solver *Lbfgsb) (PointValueGradient, ExitStatus)
+	}{
+		{"NaN", func(solver *Lbfgsb) (PointValueGradient, ExitStatus) {
+			return solver.Minimize(nanObjective, make([]float64, dim))
+		}},
+		{"ErrOutsideDomain", func(solver *Lbfgsb) (
+			PointValueGradient, ExitStatus) {
+			return solver.MinimizeErr(errObjective, make([]float64, dim))
+		}},
+	} {
+		minimum, exitStatus := run.minimize(NewLbfgsb(dim))
+		if exitStatus.Code != SUCCESS {
+			t.Errorf("%s: Minimization failed: %v", run.name, exitStatus)
+			continue
+		}
+		for i, x := range minimum.X {
+			if math.Abs(x-0.1*float64(i)) > 1e-4 {
+				t.Errorf("%s: Minimum at %v.  Expected x_i = 0.1 * i.",
+					run.name, minimum.X)
+				break
+			}
+		}
+		if exitStatus.Statistics().DomainRecoveries < 1 {
+			t.Errorf("%s: %d domain recoveries.  Expected >= 1.",
+				run.name, exitStatus.Statistics().DomainRecoveries)
+		}
+	}
+}
+
+// countingObjective counts the evaluations of an objective.
+type countingObjective struct {
+	objective            FunctionWithGradient
+	functions, gradients int
+}
+
+func (counting *countingObjective) EvaluateFunction(
+	point []float64) float64 {
+
+	counting.functions++
+	return counting.objective.EvaluateFunction(point)
+}
+
+func (counting *countingObjective) EvaluateGradient(
+	point []float64) []float64 {
+
+	counting.gradients++
+	return counting.objective.EvaluateGradient(point)
+}
+
+// TestStatistics checks the statistics of an optimization against the
+// evaluations of its objective and its minimum.
+func TestStatistics(t *testing.T) {
+	const dim = 6
+	objective := &countingObjective{objective: narrowSphere{}}
+	solver := NewLbfgsb(dim)
+	minimum, exitStatus := solver.Minimize(
+		slowObjective{objective}, make([]float64, dim))
+	if exitStatus.Code != SUCCESS {
+		t.Fatalf("Minimization failed: %v", exitStatus)
+	}
+	statistics := exitStatus.Statistics()
+
+	// The gradient is not evaluated outside the domain
+	if statistics.FunctionEvaluations != objective.functions ||
+		statistics.GradientEvaluations != objective.gradients ||
+		objective.gradients >= objective.functions {
+		t.Errorf("%d function and %d gradient evaluations.  "+
+			"Expected %d and %d (fewer).", statistics.FunctionEvaluations,
+			statistics.GradientEvaluations, objective.functions,
+			objective.gradients)
+	}
+	if statistics.Iterations <= 0 || statistics.DomainRecoveries < 1 ||
+		statistics.Restarts != 0 || statistics.RestartHistory != nil ||
+		statistics.ClampedCoordinates != nil ||
+		statistics.SkippedUpdates < 0 {
+		t.Errorf("Statistics %+v.  Expected iterations, domain "+
+			"recoveries, and nothing else.", statistics)
+	}
+	var gNorm float64
+	for _, g := range minimum.G {
+		gNorm = math.Max(gNorm, math.Abs(g))
+	}
+	if statistics.FinalGNorm != gNorm ||
+		statistics.FinalActiveVariables != 0 {
+		t.Errorf("Final GNorm %g with %d active variables.  "+
+			"Expected %g with 0.", statistics.FinalGNorm,
+			statistics.FinalActiveVariables, gNorm)
+	}
+
+	// Each evaluation takes at least a millisecond in the callbacks
+	minCallbackTime := time.Duration(objective.functions) * time.Millisecond
+	if statistics.CallbackTime < minCallbackTime ||
+		statistics.WallTime < statistics.CallbackTime ||
+		statistics.SolverTime !=
+			statistics.WallTime-statistics.CallbackTime {
+		t.Errorf("Wall time %v, callback time %v, solver time %v.  "+
+			"Expected callback time >= %v and the rest in the solver.",
+			statistics.WallTime, statistics.CallbackTime,
+			statistics.SolverTime, minCallbackTime)
+	}
+	if statistics.CauchyTime < 0 || statistics.SubspaceTime < 0 ||
+		statistics.LineSearchTime < 0 {
+		t.Errorf("Cauchy time %v, subspace time %v, line search time "+
+			"%v.  Expected >= 0.", statistics.CauchyTime,
+			statistics.SubspaceTime, statistics.LineSearchTime)
+	}
+
+	// The solver keeps the statistics of its last minimization
+	if fmt.Sprint(solver.OptimizationStatistics()) != fmt.Sprint(statistics) {
+		t.Errorf("Solver statistics %+v.  Expected %+v.",
+			solver.OptimizationStatistics(), statistics)
+	}
+}
+
+// TestWarmStart checks that the final approximation of an optimization
+// carries over to the next one: unchanged if the next one does not
+// iterate, and so that it converges in fewer iterations than a cold
+// start.
+func TestWarmStart(t *testing.T) {
+	const dim = 5
+	// Badly scaled quadratic with minimum at x_i = i + 1
+	value := func(point []float64) float64 {
+		value := 0.0
+		for i, x := range point {
+			scale := math.Pow(4, float64(i))
+			value += scale * (x - float64(i+1)) * (x - float64(i+1))
+		}
+		return value
+	}
+	gradient := func(point []float64) []float64 {
+		gradient := make([]float64, len(point))
+		for i, x := range point {
+			scale := math.Pow(4, float64(i))
+			gradient[i] = 2 * scale * (x - float64(i+1))
+		}
+		return gradient
+	}
+	objective := GeneralObjectiveFunction{value, gradient}
+
+	// Cold start
+	solver := NewLbfgsb(dim)
+	_, approximation, coldStatus := solver.MinimizeFrom(
+		nil, objective, make([]float64, dim))
+	if coldStatus.Code != SUCCESS {
+		t.Fatalf("Cold start failed: %v", coldStatus)
+	}
+	if approximation == nil || len(approximation.S) == 0 ||
+		len(approximation.S) > 5 ||
+		len(approximation.Y) != len(approximation.S) ||
+		!(approximation.Theta > 0) {
+		t.Fatalf("Final approximation %v.  Expected 1 to 5 pairs.",
+			approximation)
+	}
+
+	// Starting at the minimum does not iterate, so the approximation
+	// comes back as it went in
+	minimumPoint := []float64{1, 2, 3, 4, 5}
+	_, roundTrip, exitStatus := solver.MinimizeFrom(
+		approximation, objective, minimumPoint)
+	if exitStatus.Code != SUCCESS || exitStatus.Statistics().Iterations != 0 {
+		t.Fatalf("Minimization from the minimum: %v after %d iterations.  "+
+			"Expected success after 0.", exitStatus,
+			exitStatus.Statistics().Iterations)
+	}
+	if roundTrip == nil || len(roundTrip.S) != len(approximation.S) ||
+		roundTrip.Theta != approximation.Theta {
+		t.Fatalf("Round-tripped approximation %v.  Expected %v.",
+			roundTrip, approximation)
+	}
+	for i := range approximation.S {
+		if !equalPoints(roundTrip.S[i], approximation.S[i]) ||
+			!equalPoints(roundTrip.Y[i], approximation.Y[i]) {
+			t.Errorf("Round-tripped pair %d (%v, %v).  Expected (%v, %v).",
+				i, roundTrip.S[i], roundTrip.Y[i],
+				approximation.S[i], approximation.Y[i])
+		}
+	}
+
+	// Warm start from the same point as the cold start
+	minimum, _, warmStatus := solver.MinimizeFrom(
+		approximation, objective, make([]float64, dim))
+	if warmStatus.Code != SUCCESS {
+		t.Fatalf("Warm start failed: %v", warmStatus)
+	}
+	for i, x := range minimum.X {
+		if math.Abs(x-minimumPoint[i]) > 1e-4 {
+			t.Errorf("Warm start minimum at %v.  Expected %v.",
+				minimum.X, minimumPoint)
+			break
+		}
+	}
+	coldIterations := coldStatus.Statistics().Iterations
+	warmIterations := warmStatus.Statistics().Iterations
+	if warmIterations >= coldIterations {
+		t.Errorf("Warm start took %d iterations.  Expected fewer than "+
+			"the %d of the cold start.", warmIterations, coldIterations)
+	}
+}
+
+// TestCheckBounds checks which bounds are feasible, directly and by
+// minimizing.
+func TestCheckBounds(t *testing.T) {
+	nan, inf := math.NaN(), math.Inf(1)
+	cases := []struct {
+		bounds   [2]float64
+		feasible bool
+	}{
+		{[2]float64{nan, nan}, true},
+		{[2]float64{-inf, inf}, true},
+		{[2]float64{nan, 1}, true},
+		{[2]float64{-1, nan}, true},
+		{[2]float64{-1, 1}, true},
+		{[2]float64{1, 1}, true},
+		{[2]float64{1, -1}, false},
+		{[2]float64{inf, inf}, false},
+		{[2]float64{inf, nan}, false},
+		{[2]float64{-inf, -inf}, false},
+		{[2]float64{nan, -inf}, false},
+	}
+	for _, c := range cases {
+		solver := NewLbfgsb(1).SetBounds([][2]float64{c.bounds})
+		err := solver.checkBounds()
+		if (err == nil) != c.feasible {
+			t.Errorf("Bounds %v: Error %v.  Expected feasible: %v.",
+				c.bounds, err, c.feasible)
+		}
+		_, exitStatus := solver.Minimize(shiftedSphere{}, []float64{0})
+		if (exitStatus.Code == USAGE_ERROR) == c.feasible {
+			t.Errorf("Bounds %v: Exit status %v.  Expected feasible: %v.",
+				c.bounds, exitStatus, c.feasible)
+		}
+	}
+}
+
+// TestProjectPoint checks the projection of points into the bounds.
+func TestProjectPoint(t *testing.T) {
+	nan := math.NaN()
+	solver := NewLbfgsb(3).SetBounds([][2]float64{
+		{0, 1}, {nan, 2}, {-1, math.Inf(1)}})
+	cases := []struct {
+		point     []float64
+		projected []float64
+		clamped   []int
+	}{
+		{[]float64{0.5, -5, 5}, []float64{0.5, -5, 5}, nil},
+		{[]float64{1, 2, -1}, []float64{1, 2, -1}, nil},
+		{[]float64{2, 0, 0}, []float64{1, 0, 0}, []int{0}},
+		{[]float64{-1, 3, -2}, []float64{0, 2, -1}, []int{0, 1, 2}},
+	}
+	for _, c := range cases {
+		projected, clamped := solver.projectPoint(c.point)
+		if !equalPoints(projected, c.projected) ||
+			fmt.Sprint(clamped) != fmt.Sprint(c.clamped) {
+			t.Errorf("Projected %v to %v clamping %v.  "+
+				"Expected %v clamping %v.", c.point, projected, clamped,
+				c.projected, c.clamped)
+		}
+		// A point that is inside is not copied
+		if c.clamped == nil && &projected[0] != &c.point[0] {
+			t.Errorf("Projecting %v copied it.", c.point)
+		}
+	}
+
+	// Minimizing from outside the bounds projects the initial point or
+	// rejects it
+	solver = NewLbfgsb(3).SetBoundsAll(-1, 1)
+	minimum, exitStatus := solver.Minimize(
+		shiftedSphere{}, []float64{5, -5, 0})
+	if exitStatus.Code != SUCCESS {
+		t.Fatalf("Minimization failed: %v", exitStatus)
+	}
+	for i, x := range []float64{0, 1, 1} {
+		if math.Abs(minimum.X[i]-x) > 1e-4 {
+			t.Errorf("Minimum at %v.  Expected [0 1 1].", minimum.X)
+			break
+		}
+	}
+	clamped := exitStatus.Statistics().ClampedCoordinates
+	if fmt.Sprint(clamped) != "[0 1]" {
+		t.Errorf("Clamped coordinates %v.  Expected [0 1].", clamped)
+	}
+	_, exitStatus = solver.SetProjectInitialPoint(false).Minimize(
+		shiftedSphere{}, []float64{5, -5, 0})
+	if exitStatus.Code != USAGE_ERROR {
+		t.Errorf("Exit status %v.  Expected %v.", exitStatus.Code,
+			USAGE_ERROR)
+	}
+}
+
+// TestActiveSetTracker checks the changes in the active set reported
+// from point to point.
+func TestActiveSetTracker(t *testing.T) {
+	nan := math.NaN()
+	solver := NewLbfgsb(4).SetBounds([][2]float64{
+		{0, 1}, {0, 1}, {nan, nan}, {2, 2}})
+	tracker := solver.newActiveSetTracker([]float64{0, 0.5, 0, 2})
+	steps := []struct {
+		point   []float64
+		changes []ActiveSetChange
+		size    int
+	}{
+		{[]float64{0.5, 1, 0, 2}, []ActiveSetChange{
+			{0, LOWER_BOUND, false},
+			{1, UPPER_BOUND, true},
+		}, 2},
+		{[]float64{0.5, 1, 5, 2}, nil, 2},
+		{[]float64{1, 0, 0, 2}, []ActiveSetChange{
+			{0, UPPER_BOUND, true},
+			{1, UPPER_BOUND, false},
+			{1, LOWER_BOUND, true},
+		}, 3},
+	}
+	for _, step := range steps {
+		changes := tracker.update(step.point)
+		if fmt.Sprint(changes) != fmt.Sprint(step.changes) {
+			t.Errorf("Changes at %v: %v.  Expected %v.",
+				step.point, changes, step.changes)
+		}
+		if size := tracker.size(step.point); size != step.size {
+			t.Errorf("Active set size at %v: %d.  Expected %d.",
+				step.point, size, step.size)
+		}
+	}
+
+	// Without a previous point, the changes are not known
+	tracker = solver.newActiveSetTracker(nil)
+	if changes := tracker.update([]float64{0, 0, 0, 2}); changes != nil {
+		t.Errorf("Changes without a previous point: %v.  Expected none.",
+			changes)
+	}
+}
+
+// TestActiveSetChanges minimizes with bounds that some coordinates of
+// the minimum are at and checks that the changes reported for each
+// iterate, through a logger and through a session, account for the
+// active set of every iterate.
+func TestActiveSetChanges(t *testing.T) {
+	// The minimum of the shifted sphere is at (0.5, 1, 1.5) in these
+	// bounds
+	const dim = 3
+	solver := NewLbfgsb(dim).SetBoundsAll(0.5, 1.5)
+	initialPoint := []float64{1, 1, 1}
+	expected := []Bound{LOWER_BOUND, NO_BOUND, UPPER_BOUND}
+
+	// check applies the given changes to the given active set and
+	// checks the result against the given iterate
+	check := func(name string, active []Bound, x []float64,
+		changes []ActiveSetChange) {
+
+		for _, change := range changes {
+			if change.Entering && active[change.Index] != NO_BOUND ||
+				!change.Entering && active[change.Index] != change.Bound {
+				t.Errorf("%s: Change %v from %v.", name, change,
+					active[change.Index])
+			}
+			if change.Entering {
+				active[change.Index] = change.Bound
+			} else {
+				active[change.Index] = NO_BOUND
+			}
+		}
+		for i := range x {
+			bound := NO_BOUND
+			if x[i] == 0.5 {
+				bound = LOWER_BOUND
+			} else if x[i] == 1.5 {
+				bound = UPPER_BOUND
+			}
+			if active[i] != bound {
+				t.Errorf("%s: Active set %v at %v.  Expected %v.",
+					name, active, x, bound)
+				return
+			}
+		}
+	}
+
+	// Through a logger
+	active := make([]Bound, dim)
+	solver.SetLogger(func(info *OptimizationIterationInformation) {
+		check(fmt.Sprintf("Iteration %d", info.Iteration),
+			active, info.X, info.ActiveSetChanges)
+	})
+	_, exitStatus := solver.Minimize(shiftedSphere{}, initialPoint)
+	if exitStatus.Code != SUCCESS {
+		t.Fatalf("Minimization failed: %v", exitStatus)
+	}
+	if fmt.Sprint(active) != fmt.Sprint(expected) {
+		t.Errorf("Active set %v at the minimum.  Expected %v.",
+			active, expected)
+	}
+	if exitStatus.Statistics().FinalActiveVariables != 2 {
+		t.Errorf("%d active variables at the minimum.  Expected 2.",
+			exitStatus.Statistics().FinalActiveVariables)
+	}
+
+	// Through a session
+	active = make([]Bound, dim)
+	session := solver.SetLogger(nil).NewSession(initialPoint)
+	for request := session.Next(); request.Kind != DONE; request = session.Next() {
+		switch request.Kind {
+		case EVALUATE:
+			session.Provide(shiftedSphere{}.EvaluateFunction(request.X),
+				shiftedSphere{}.EvaluateGradient(request.X))
+		case NEW_ITERATE:
+			check(fmt.Sprintf("Session iteration %d", request.Iteration),
+				active, request.X, request.ActiveSetChanges)
+		}
+	}
+	if fmt.Sprint(active) != fmt.Sprint(expected) {
+		t.Errorf("Session active set %v at the minimum.  Expected %v.",
+			active, expected)
+	}
+}
+
+// TestWorkspace checks that a workspace can be reused by minimizations
+// one after another, including by different goroutines, and that it
+// must match the shape of the solver.
+func TestWorkspace(t *testing.T) {
+	const dim = 6
+	solver := NewLbfgsb(dim)
+	workspace := solver.NewWorkspace()
+	if workspace.Dimensionality() != dim ||
+		workspace.ApproximationSize() != 5 {
+		t.Errorf("Workspace shape (%d, %d).  Expected (%d, 5).",
+			workspace.Dimensionality(), workspace.ApproximationSize(), dim)
+	}
+	solver.SetWorkspace(workspace)
+
+	// Reusing the workspace leaves nothing behind from before
+	for _, start := range []float64{-3, 10, -3} {
+		initialPoint := make([]float64, dim)
+		for i := range initialPoint {
+			initialPoint[i] = start
+		}
+		minimum, exitStatus := solver.Minimize(rosenbrock{}, initialPoint)
+		expected, expectedStatus := NewLbfgsb(dim).
+			Minimize(rosenbrock{}, initialPoint)
+		if exitStatus.Code != expectedStatus.Code ||
+			!equalPoints(minimum.X, expected.X) ||
+			exitStatus.Statistics().Iterations !=
+				expectedStatus.Statistics().Iterations {
+			t.Errorf("Start %g: Exit status %v, minimum at %v after %d "+
+				"iterations.  Expected %v at %v after %d.", start,
+				exitStatus, minimum.X, exitStatus.Statistics().Iterations,
+				expectedStatus, expected.X,
+				expectedStatus.Statistics().Iterations)
+		}
+	}
+
+	// A workspace of another shape is a usage error
+	for _, shape := range [][2]int{{dim + 1, 5}, {dim, 4}} {
+		_, exitStatus := NewLbfgsb(dim).
+			SetWorkspace(NewWorkspace(shape[0], shape[1])).
+			Minimize(shiftedSphere{}, make([]float64, dim))
+		if exitStatus.Code != USAGE_ERROR {
+			t.Errorf("Workspace shape %v: Exit status %v.  Expected %v.",
+				shape, exitStatus, USAGE_ERROR)
+		}
+	}
+
+	// Creating a workspace for a solver needs its dimensionality
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("No panic.  Expected a panic.")
+			}
+		}()
+		new(Lbfgsb).NewWorkspace()
+	}()
+
+	// Workers share a pool of fewer workspaces, each used by one
+	// minimization at a time
+	const workers = 16
+	pool := make(chan *Workspace, 4)
+	for i := 0; i < cap(pool); i++ {
+		pool <- NewWorkspace(dim, 5)
+	}
+	var wait sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wait.Add(1)
+		go func(w int) {
+			defer wait.Done()
+			workspace := <-pool
+			defer func() { pool <- workspace }()
+			initialPoint := make([]float64, dim)
+			for i := range initialPoint {
+				initialPoint[i] = float64(w - i)
+			}
+			minimum, exitStatus := NewLbfgsb(dim).
+				SetWorkspace(workspace).
+				Minimize(shiftedSphere{}, initialPoint)
+			checkMinimum(t, minimum, exitStatus, 1e-4)
+		}(w)
+	}
+	wait.Wait()
+}
+
+// TestWorkspaceTooLarge checks that a workspace whose memory a C int
+// cannot index is rejected before any Fortran code sees its shape.
+func TestWorkspaceTooLarge(t *testing.T) {
+	cases := []struct {
+		dimensionality, approximationSize int
+		valid                             bool
+	}{
+		{1, 1, true},
+		{1000000, 5, true},
+		// The largest real memory that fits and the smallest that
+		// does not (13 * dimensionality + 55 elements)
+		{165191045, 1, true},
+		{165191046, 1, false},
+		{1 << 30, 1, false},
+		{1, 1 << 16, false},
+		{1 << 20, 2000, false},
+	}
+	for _, c := range cases {
+		err := checkWorkspaceShape(c.dimensionality, c.approximationSize)
+		if (err == nil) != c.valid {
+			t.Errorf("Shape (%d, %d): Error %v.  Expected valid: %v.",
+				c.dimensionality, c.approximationSize, err, c.valid)
+		}
+	}
+
+	// Creating such a workspace panics and minimizing is a usage error
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("No panic.  Expected a panic.")
+			}
+		}()
+		NewWorkspace(1<<20, 2000)
+	}()
+	const dim = 1 << 20
+	_, exitStatus := NewLbfgsb(dim).
+		SetApproximationSize(2000).
+		Minimize(shiftedSphere{}, make([]float64, dim))
+	if exitStatus.Code != USAGE_ERROR {
+		t.Errorf("Exit status %v.  Expected %v.", exitStatus.Code,
+			USAGE_ERROR)
+	}
+}
@@ -6,7 +6,10 @@
 package lbfgsb
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"time"
 )
 
 ////////////////////////////////////////
@@ -28,6 +31,19 @@ type ObjectiveFunctionMinimizer interface {
 		minimum PointValueGradient, exitStatus ExitStatus)
 }
 
+// ObjectiveFunctionMinimizerContext is an ObjectiveFunctionMinimizer
+// whose minimization can be cancelled or limited in time with a
+// context.
+type ObjectiveFunctionMinimizerContext interface {
+	ObjectiveFunctionMinimizer
+	// MinimizeContext is like Minimize but stops early when the given
+	// context is done.  Returns the best point found so far and an
+	// exit status that wraps the context's error.
+	MinimizeContext(ctx context.Context,
+		objective FunctionWithGradient, initialPoint []float64) (
+		minimum PointValueGradient, exitStatus ExitStatus)
+}
+
 ////////////////////////////////////////
 // Optimization inputs
 
@@ -58,11 +74,98 @@ func (gof GeneralObjectiveFunction) EvaluateGradient(point []float64) []float64
 	return gof.Gradient(point)
 }
 
+// FunctionWithGradientErr is like FunctionWithGradient but for
+// functions whose evaluation can fail, for example because they read
+// data from disk or over a network.  Returning ErrOutsideDomain (or an
+// error that wraps it) is not a failure but means the point is outside
+// the domain of the function.
+type FunctionWithGradientErr interface {
+	// EvaluateFunction returns the value of the function at the given
+	// point or an error if it could not be evaluated.
+	EvaluateFunction(point []float64) (float64, error)
+	// EvaluateGradient returns the gradient of the function at the
+	// given point or an error if it could not be evaluated.
+	EvaluateGradient(point []float64) ([]float64, error)
+}
+
+// ErrOutsideDomain is the error with which an objective that can fail
+// signals that it is not defined at the given point, for example a
+// log-likelihood at a negative variance.  Optimizers treat such a point
+// like one where the objective is not finite (NaN or Inf): during a
+// line search, they try a shorter step instead.
+var ErrOutsideDomain = errors.New("Lbfgsb: Point outside the domain of the objective")
+
+// GeneralObjectiveFunctionErr is a utility object that combines
+// individual Go functions into a FunctionWithGradientErr.
+type GeneralObjectiveFunctionErr struct {
+	Function func([]float64) (float64, error)
+	Gradient func([]float64) ([]float64, error)
+}
+
+func (gof GeneralObjectiveFunctionErr) EvaluateFunction(point []float64) (float64, error) {
+	return gof.Function(point)
+}
+
+func (gof GeneralObjectiveFunctionErr) EvaluateGradient(point []float64) ([]float64, error) {
+	return gof.Gradient(point)
+}
+
+// CombinedFunctionWithGradient is a FunctionWithGradient that can also
+// evaluate its value and gradient together, which is useful when that
+// is cheaper than evaluating them separately.  Optimizers use
+// EvaluateFunctionGradient instead of the separate methods if it is
+// available.
+type CombinedFunctionWithGradient interface {
+	FunctionWithGradient
+	// EvaluateFunctionGradient returns the value of the function at
+	// the given point and stores the gradient at the given point in
+	// the given gradient slice (which has the same length as the
+	// point).  The slices are owned by the optimizer and are only
+	// valid for the duration of the call.
+	EvaluateFunctionGradient(point, gradient []float64) float64
+}
+
+// CombinedFunctionWithGradientErr is to FunctionWithGradientErr as
+// CombinedFunctionWithGradient is to FunctionWithGradient.
+type CombinedFunctionWithGradientErr interface {
+	FunctionWithGradientErr
+	// EvaluateFunctionGradient is like
+	// CombinedFunctionWithGradient.EvaluateFunctionGradient but returns
+	// an error if the function could not be evaluated.
+	EvaluateFunctionGradient(point, gradient []float64) (float64, error)
+}
+
+// BatchFunctionWithGradient is an objective function that evaluates
+// many points at once, for example because it is vectorized.  The
+// points may be from different problems (see BatchLbfgsb).
+type BatchFunctionWithGradient interface {
+	// EvaluateBatch returns the values and gradients at the given
+	// points, in the same order.  The points are owned by the
+	// optimizer and are only valid for the duration of the call.
+	EvaluateBatch(points [][]float64) (values []float64, gradients [][]float64)
+}
+
 // OptimizationIterationLogger is the type of function that
 // logs/records/processes information about a single iteration in an
 // optimization run.
 type OptimizationIterationLogger func(info *OptimizationIterationInformation)
 
+// OptimizationStopCondition is the type of function that decides
+// whether to stop an optimization run early based on information about
+// its most recent iteration.  Returns whether to stop and, if so, the
+// reason for stopping.
+type OptimizationStopCondition func(
+	info *OptimizationIterationInformation) (stop bool, reason string)
+
+// OptimizationWarningHandler is the type of function that is told
+// about each warning during an optimization run as it happens.
+type OptimizationWarningHandler func(warning Warning)
+
+// OptimizationEvaluationObserver is the type of function that is told
+// about each evaluation of the objective during an optimization run,
+// including the trial points of line searches.
+type OptimizationEvaluationObserver func(info EvaluationInfo)
+
 // OptimizationIterationInformation is a container for information about
 // an optimization iteration.
 type OptimizationIterationInformation struct {
@@ -79,12 +182,45 @@ type OptimizationIterationInformation struct {
 	FDeltaBound float64
 	GNorm       float64
 	GNormBound  float64
+
+	// Internals of L-BFGS-B, for diagnosing difficult problems.  The
+	// counts of skipped updates and segments start over after a
+	// restart (see Lbfgsb.SetRestartPolicy).
+
+	// Scaling factor of the BFGS matrix
+	Theta float64
+	// Number of BFGS updates skipped so far because the curvature
+	// condition did not hold
+	SkippedUpdates int
+	// Numbers of segments explored in the search for the generalized
+	// Cauchy point in this iteration and so far
+	Segments      int
+	SegmentsTotal int
+	// Numbers of free variables and of active variables (variables at
+	// a bound) at the generalized Cauchy point
+	FreeVariables   int
+	ActiveVariables int
+	// Whether the subspace minimization was stopped at a bound
+	SubspaceTruncated bool
+	// Norm of the search direction of the line search
+	DirectionNorm float64
+	// Directional derivatives along the search direction at the start
+	// and at the end of the line search
+	InitialSlope float64
+	Slope        float64
+
+	// Changes in the active set (the variables at a bound) since the
+	// previous iterate (or the initial point), in order of index.  Nil
+	// if there were none.  Not known for the first iteration after
+	// resuming from a checkpoint.
+	ActiveSetChanges []ActiveSetChange
 }
 
 // Header returns a string with descriptions for the fields returned by
 // String().
 func (oii *OptimizationIterationInformation) Header() string {
-	return "iter, f(x), step, df(x) <1?, ||f'(x)|| <1?, #f(), #g()"
+	return "iter, f(x), step, df(x) <1?, ||f'(x)|| <1?, #f(), #g(), " +
+		"theta, #skip, #seg, #free, #act, trunc?, ||d||, f'(d) start, end"
 }
 
 // String formats the iteration information fields as a row in a table.
@@ -101,12 +237,127 @@ func (oii *OptimizationIterationInformation) String() string {
 	if gConvRatio < 1.0 {
 		gConvIndicator = "T"
 	}
+	// Was the subspace minimization truncated?
+	truncIndicator := "F"
+	if oii.SubspaceTruncated {
+		truncIndicator = "T"
+	}
 	// Put all the fields together
-	return fmt.Sprintf("%d %g %g %g %.2g%v %g %.2g%v %d %d",
+	return fmt.Sprintf("%d %g %g %g %.2g%v %g %.2g%v %d %d "+
+		"%g %d %d %d %d %v %g %g %g",
 		oii.Iteration, oii.F, oii.StepLength,
 		oii.FDelta, fConvRatio, fConvIndicator,
 		oii.GNorm, gConvRatio, gConvIndicator,
-		oii.FEvals, oii.GEvals)
+		oii.FEvals, oii.GEvals,
+		oii.Theta, oii.SkippedUpdates, oii.Segments,
+		oii.FreeVariables, oii.ActiveVariables, truncIndicator,
+		oii.DirectionNorm, oii.InitialSlope, oii.Slope)
+}
+
+// EvaluationPhase is the phase of an optimization in which an
+// evaluation of the objective happens.  Values match the C enum
+// lbfgsb_phase.
+type EvaluationPhase uint8
+
+// EvaluationPhase values
+const (
+	// Evaluation of the initial point
+	START_PHASE EvaluationPhase = iota
+	// Evaluation of a trial point of a line search
+	LINE_SEARCH_PHASE
+	// Evaluation of the point restarted from (see
+	// Lbfgsb.SetRestartPolicy)
+	RESTART_PHASE
+)
+
+// String returns the name of this phase.
+func (ep EvaluationPhase) String() string {
+	switch ep {
+	case START_PHASE:
+		return "START_PHASE"
+	case LINE_SEARCH_PHASE:
+		return "LINE_SEARCH_PHASE"
+	case RESTART_PHASE:
+		return "RESTART_PHASE"
+	default:
+		return fmt.Sprintf("EvaluationPhase(%d)", uint8(ep))
+	}
+}
+
+// EvaluationInfo is a container for information about an evaluation
+// of the objective.  X and G belong to the optimization and are only
+// valid during the call to the observer, so copy them to keep them.
+type EvaluationInfo struct {
+	// Number of this evaluation, counting from 1
+	Evaluation int
+	// Number of iterations completed
+	Iteration int
+	Phase     EvaluationPhase
+	// Length of the step from the current iterate to X (zero except in
+	// the line search)
+	StepLength float64
+	X          []float64
+	F          float64
+	G          []float64
+	// Infinity norm of the projected gradient (NaN if G is not finite)
+	GNorm float64
+	// Time spent evaluating the objective
+	Elapsed time.Duration
+}
+
+// String formats the evaluation information as text.
+func (ei EvaluationInfo) String() string {
+	return fmt.Sprintf("Evaluation: %d; Iteration: %d; Phase: %v; Step: %g; F: %g; GNorm: %g; Elapsed: %v;",
+		ei.Evaluation, ei.Iteration, ei.Phase, ei.StepLength,
+		ei.F, ei.GNorm, ei.Elapsed)
+}
+
+// Bound is the bound of a variable that a point is at, if any.
+type Bound uint8
+
+// Bound values
+const (
+	// Not at a bound (a free variable)
+	NO_BOUND Bound = iota
+	LOWER_BOUND
+	UPPER_BOUND
+)
+
+// String returns the name of this bound.
+func (b Bound) String() string {
+	switch b {
+	case NO_BOUND:
+		return "NO_BOUND"
+	case LOWER_BOUND:
+		return "LOWER_BOUND"
+	case UPPER_BOUND:
+		return "UPPER_BOUND"
+	default:
+		return fmt.Sprintf("Bound(%d)", uint8(b))
+	}
+}
+
+// ActiveSetChange describes a variable entering or leaving the active
+// set, that is, arriving at or departing from one of its bounds.  A
+// variable that moves from one bound to the other in one iteration
+// makes two changes: leaving the first bound and entering the other.
+type ActiveSetChange struct {
+	// Index of the variable
+	Index int
+	// The bound entered or left, LOWER_BOUND or UPPER_BOUND
+	Bound Bound
+	// Whether the variable entered (true) or left (false) the bound
+	Entering bool
+}
+
+// String returns the variable, bound, and direction of this change as
+// text.
+func (asc ActiveSetChange) String() string {
+	direction := "leaving"
+	if asc.Entering {
+		direction = "entering"
+	}
+	return fmt.Sprintf("%d %v %v", asc.Index, direction, asc.Bound)
 }
 
 ////////////////////////////////////////
@@ -149,6 +400,11 @@ type PointValueGradient struct {
 //
 // 6. Internal error.  Other runtime or programming/logic error which
 // may be a bug.  Responsibility is on this package.
+//
+// Finally, optimization can be stopped from outside:
+//
+// 7. Canceled.  The context of the optimization was cancelled or its
+// deadline passed.  The result is the best point found so far.
 type ExitStatusCode uint8
 
 // ExitStatusCode values.
@@ -159,6 +415,7 @@ const (
 	FAILURE
 	USAGE_ERROR
 	INTERNAL_ERROR
+	CANCELED
 )
 
 // String returns a word for each ExitStatusCode.
@@ -176,21 +433,201 @@ func (esc ExitStatusCode) String() string {
 		return "USAGE_ERROR"
 	case INTERNAL_ERROR:
 		return "INTERNAL_ERROR"
+	case CANCELED:
+		return "CANCELED"
 	default:
 		return "UNKNOWN"
 	}
 }
 
+// TerminationReason describes why an optimization algorithm stopped in
+// more detail than its ExitStatusCode, so that callers can act on
+// particular situations without matching messages.  Each reason other
+// than UNKNOWN_REASON has a corresponding sentinel error (see Err) so
+// that an ExitStatus can also be examined with errors.Is.
+type TerminationReason uint8
+
+// TerminationReason values.  These match the LBFGSB_REASON_* values in
+// the Fortran module.
+const (
+	// Not terminated or reason not known
+	UNKNOWN_REASON TerminationReason = iota
+	// Norm of the projected gradient is within the tolerance
+	CONVERGED_PROJECTED_GRADIENT
+	// Relative reduction of the objective is within the tolerance
+	CONVERGED_RELATIVE_REDUCTION
+	// Line search could not find an acceptable point
+	ABNORMAL_LINE_SEARCH
+	// Line search warnings
+	ROUNDING_ERRORS
+	XTOL_TEST_SATISFIED
+	STEP_AT_MAXIMUM
+	STEP_AT_MINIMUM
+	// Maximum number of iterations or evaluations reached
+	ITERATION_LIMIT
+	EVALUATION_LIMIT
+	// A callback (context, stop condition) stopped the optimization
+	// early
+	CALLBACK_STOP
+	// A callback (objective) failed
+	CALLBACK_ERROR
+	// Invalid inputs such as bounds or dimensions
+	INVALID_INPUT
+	// The algorithm ended up in a situation this package does not
+	// recognize
+	UNRECOGNIZED_TASK
+)
+
+// Sentinel errors for termination reasons.  An ExitStatus matches the
+// one for its reason with errors.Is.
+var (
+	ErrConvergedProjectedGradient = errors.New("Lbfgsb: Converged: norm of projected gradient within tolerance")
+	ErrConvergedRelativeReduction = errors.New("Lbfgsb: Converged: relative reduction of objective within tolerance")
+	ErrAbnormalLineSearch         = errors.New("Lbfgsb: Abnormal termination in line search")
+	ErrRoundingErrors             = errors.New("Lbfgsb: Rounding errors prevent progress")
+	ErrXtolTestSatisfied          = errors.New("Lbfgsb: Line search step tolerance (xtol) satisfied")
+	ErrStepAtMaximum              = errors.New("Lbfgsb: Line search step at maximum")
+	ErrStepAtMinimum              = errors.New("Lbfgsb: Line search step at minimum")
+	ErrIterationLimit             = errors.New("Lbfgsb: Iteration limit reached")
+	ErrEvaluationLimit            = errors.New("Lbfgsb: Evaluation limit reached")
+	ErrCallbackStop               = errors.New("Lbfgsb: Stopped by callback")
+	ErrCallbackError              = errors.New("Lbfgsb: Callback failed")
+	ErrInvalidInput               = errors.New("Lbfgsb: Invalid input")
+	ErrUnrecognizedTask           = errors.New("Lbfgsb: Unrecognized task")
+)
+
+// terminationReasonInfo holds the name and sentinel error of each
+// TerminationReason, indexed by reason.
+var terminationReasonInfo = [...]struct {
+	name string
+	err  error
+}{
+	UNKNOWN_REASON:               {"UNKNOWN_REASON", nil},
+	CONVERGED_PROJECTED_GRADIENT: {"CONVERGED_PROJECTED_GRADIENT", ErrConvergedProjectedGradient},
+	CONVERGED_RELATIVE_REDUCTION: {"CONVERGED_RELATIVE_REDUCTION", ErrConvergedRelativeReduction},
+	ABNORMAL_LINE_SEARCH:         {"ABNORMAL_LINE_SEARCH", ErrAbnormalLineSearch},
+	ROUNDING_ERRORS:              {"ROUNDING_ERRORS", ErrRoundingErrors},
+	XTOL_TEST_SATISFIED:          {"XTOL_TEST_SATISFIED", ErrXtolTestSatisfied},
+	STEP_AT_MAXIMUM:              {"STEP_AT_MAXIMUM", ErrStepAtMaximum},
+	STEP_AT_MINIMUM:              {"STEP_AT_MINIMUM", ErrStepAtMinimum},
+	ITERATION_LIMIT:              {"ITERATION_LIMIT", ErrIterationLimit},
+	EVALUATION_LIMIT:             {"EVALUATION_LIMIT", ErrEvaluationLimit},
+	CALLBACK_STOP:                {"CALLBACK_STOP", ErrCallbackStop},
+	CALLBACK_ERROR:               {"CALLBACK_ERROR", ErrCallbackError},
+	INVALID_INPUT:                {"INVALID_INPUT", ErrInvalidInput},
+	UNRECOGNIZED_TASK:            {"UNRECOGNIZED_TASK", ErrUnrecognizedTask},
+}
+
+// String returns a name for each TerminationReason.
+func (tr TerminationReason) String() string {
+	if int(tr) < len(terminationReasonInfo) {
+		return terminationReasonInfo[tr].name
+	}
+	return "UNKNOWN_REASON"
+}
+
+// Err returns the sentinel error for this TerminationReason or nil if
+// there is none.
+func (tr TerminationReason) Err() error {
+	if int(tr) < len(terminationReasonInfo) {
+		return terminationReasonInfo[tr].err
+	}
+	return nil
+}
+
+// Warning describes numerical trouble during an optimization run that
+// did not stop it, for example a line search that ended because
+// rounding errors prevented progress.  The optimization accepts the
+// step it has and continues (or restarts, if the line search failed
+// and restarts are allowed), so a run that succeeds may still have had
+// warnings.
+type Warning struct {
+	// Iteration in which the trouble happened (for a restart, the
+	// number of iterations completed before it)
+	Iteration int
+	// What happened, one of the line search warnings:
+	// ROUNDING_ERRORS, XTOL_TEST_SATISFIED, STEP_AT_MAXIMUM,
+	// STEP_AT_MINIMUM, or ABNORMAL_LINE_SEARCH for a restart (see
+	// Lbfgsb.SetRestartPolicy)
+	Reason TerminationReason
+}
+
+// String returns the iteration and reason of this warning as text.
+func (w Warning) String() string {
+	return fmt.Sprintf("Warning: Iteration: %d; Reason: %v;",
+		w.Iteration, w.Reason)
+}
+
 // ExitStatus is the exit status of an optimization algorithm.  Includes
-// a status code and a message explaining the situation.
+// a status code, the reason for termination, and a message explaining
+// the situation.  May also wrap an underlying error that caused the
+// exit, for example a context error or an error from evaluating the
+// objective.  Use errors.Is, errors.As, or errors.Unwrap to access it.
+// errors.Is also matches the sentinel error of the termination reason.
+//
+// ExitStatus values can be used with ==, but it compares the
+// statistics, warnings, and underlying error by identity (they are not
+// comparable, so they are kept behind a pointer).  So the exit status
+// of an optimization run is == only to its copies, never to a literal
+// or to the exit status of another run.  Use Equal to compare
+// outcomes.
 type ExitStatus struct {
 	Code    ExitStatusCode
+	Reason  TerminationReason
 	Message string
+	// Whether the returned minimum is a fallback (the best point
+	// evaluated) rather than the final iterate of the algorithm
+	Fallback bool
+
+	// Statistics, warnings, and underlying error (nil if there are
+	// none)
+	details *exitDetails
+}
+
+// exitDetails is the part of an ExitStatus that is not comparable.
+type exitDetails struct {
+	statistics OptimizationStatistics
+	warnings   []Warning
+	cause      error
+}
+
+// Statistics returns statistics about the optimization run.
+func (es ExitStatus) Statistics() OptimizationStatistics {
+	if es.details == nil {
+		return OptimizationStatistics{}
+	}
+	return es.details.statistics
+}
+
+// Warnings returns the warnings during the optimization run, in order.
+func (es ExitStatus) Warnings() []Warning {
+	if es.details == nil {
+		return nil
+	}
+	return es.details.warnings
+}
+
+// mutableDetails returns the details of this exit status for filling
+// in, allocating them if necessary.
+func (es *ExitStatus) mutableDetails() *exitDetails {
+	if es.details == nil {
+		es.details = &exitDetails{}
+	}
+	return es.details
 }
 
-// String returns the exit status code and message as text.
+// Equal reports whether this exit status has the same outcome as the
+// given one: the same code, reason, message, and fallback.  The
+// statistics, warnings, and underlying errors are not compared.
+func (es ExitStatus) Equal(other ExitStatus) bool {
+	return es.Code == other.Code && es.Reason == other.Reason &&
+		es.Message == other.Message && es.Fallback == other.Fallback
+}
+
+// String returns the exit status code, reason, and message as text.
 func (es ExitStatus) String() string {
-	return fmt.Sprintf("Exit status: %v; Message: %v;", es.Code, es.Message)
+	return fmt.Sprintf("Exit status: %v; Reason: %v; Message: %v;",
+		es.Code, es.Reason, es.Message)
 }
 
 // Error allows this ExitStatus to be treated like an error object.
@@ -198,6 +635,22 @@ func (es ExitStatus) Error() string {
 	return es.String()
 }
 
+// Unwrap returns the underlying error that caused this exit status, if
+// any, otherwise nil.
+func (es ExitStatus) Unwrap() error {
+	if es.details == nil {
+		return nil
+	}
+	return es.details.cause
+}
+
+// Is reports whether the given error is the sentinel error of this exit
+// status's termination reason.  Supports errors.Is.
+func (es ExitStatus) Is(target error) bool {
+	err := es.Reason.Err()
+	return err != nil && err == target
+}
+
 // AsError returns an error representing this exit status.  If the exit
 // status code is 'SUCCESS' then AsError returns nil.  Otherwise returns
 // an error object (which happens to be this object).
@@ -212,9 +665,56 @@ func (es ExitStatus) AsError() error {
 // optimization run.  Values can be negative to indicate they were not
 // tracked.
 type OptimizationStatistics struct {
-	Iterations          int
+	Iterations int
+	// Numbers of evaluations of the objective function and of its
+	// gradient.  The gradient is not evaluated where the value is not
+	// finite.
 	FunctionEvaluations int
 	GradientEvaluations int
+	// Number of times the line search backtracked (tried a shorter step
+	// from the previous iterate) because the objective was not finite
+	// or was outside its domain at a trial point
+	DomainRecoveries int
+	// Number of times the optimization was restarted after its line
+	// search failed, and the progress made before each restart
+	Restarts       int
+	RestartHistory []RestartStatistics
+	// Indices of the coordinates of the initial point that were
+	// clamped to their bounds because they were outside them
+	ClampedCoordinates []int
+	// Number of BFGS updates skipped because the curvature condition
+	// did not hold
+	SkippedUpdates int
+	// Infinity norm of the projected gradient at the minimum (NaN if
+	// the gradient is not finite) and number of variables of the
+	// minimum at a bound
+	FinalGNorm           float64
+	FinalActiveVariables int
+	// Time the run took, the part of it spent in the callbacks (the
+	// objective, logger, checkpointing, and so on; for a Session, the
+	// caller's work between requests), and the rest, spent in the
+	// solver.  Only the run itself counts, not any run before resuming.
+	WallTime     time.Duration
+	CallbackTime time.Duration
+	SolverTime   time.Duration
+	// CPU time L-BFGS-B spent in the search for the generalized Cauchy
+	// point, the subspace minimization, and the line search (not
+	// including evaluations), as measured by the Fortran code.  These
+	// include the time before resuming.
+	CauchyTime     time.Duration
+	SubspaceTime   time.Duration
+	LineSearchTime time.Duration
+}
+
+// RestartStatistics describes the progress of an optimization run when
+// it was restarted: the total numbers of iterations and evaluations
+// done before the restart and the objective value and infinity norm of
+// the projected gradient at the iterate it restarted from.
+type RestartStatistics struct {
+	Iteration   int
+	Evaluations int
+	F           float64
+	GNorm       float64
 }
 
 // OptimizationStatisticser is an object that can supply statistics
@@ -0,0 +1,246 @@
+// Copyright (c) 2014 Aubrey Barnard.  This is free software.  See
+// LICENSE.txt for details.
+
+// Routing of the output of the Fortran code into Go writers.
+
+package lbfgsb
+
+// #include "lbfgsb_go_interface.h"
+import "C"
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// Default file of the summary of the iterations, as in the original
+// Fortran code
+const iterateFileName = "iterate.dat"
+
+// fortranOutputLock serializes the writing of collected output so that
+// the output of concurrent runs does not interleave even if they share
+// a writer (or the default file of the summary of the iterations).
+var fortranOutputLock sync.Mutex
+
+// Amount of output collected in memory for a writer beyond which it is
+// spilled to a temporary file until the run is done
+const maxCollectedOutput = 1 << 20
+
+// fortranOutput is the output of one run of the Fortran code: the
+// Fortran units it prints to and the pipes through which the output
+// is collected for writers.  (A pipe is a real pipe where the Fortran
+// code can open it by name through '/dev/fd' and a temporary file
+// elsewhere; see newFortranPipe.)
+type fortranOutput struct {
+	outputUnit_c  C.int
+	iterateUnit_c C.int
+	// Units opened for the run
+	units []C.int
+	// Pipes whose contents are being collected for writers
+	pipes []*fortranPipe
+}
+
+// fortranOutputSetup is the setup of the output of the Fortran code:
+// the print control and the writers of the output and the summary of
+// the iterations (nil for the defaults, see SetFortranOutput and
+// SetIterateFile).
+type fortranOutputSetup struct {
+	printControl int
+	output       io.Writer
+	iterateFile  io.Writer
+}
+
+// fortranOutputSetup returns the setup of the Fortran output of this
+// solver.
+func (lbfgsb *Lbfgsb) fortranOutputSetup() fortranOutputSetup {
+	return fortranOutputSetup{
+		printControl: lbfgsb.printControl,
+		output:       lbfgsb.fortranOutput,
+		iterateFile:  lbfgsb.iterateFile,
+	}
+}
+
+// openFortranOutput opens the output units for a run of the Fortran
+// code as set up in this solver.  See fortranOutputSetup.open.
+func (lbfgsb *Lbfgsb) openFortranOutput(
+	resume bool) (output *fortranOutput, err error) {
+
+	return lbfgsb.fortranOutputSetup().open(resume)
+}
+
+// open opens the output units for a run of the Fortran code with this
+// setup.  The summary of the iterations is only opened if the print
+// control asks for it.  By default it is written to the file
+// iterateFileName, which is appended to if the run continues an
+// earlier one.  The output must be closed when the run is done.
+func (setup fortranOutputSetup) open(
+	resume bool) (output *fortranOutput, err error) {
+
+	// Nothing is printed at print control 0 except for an ascent
+	// direction in the line search, which is also reported as an
+	// abnormal line search, so nothing is opened at all
+	output = &fortranOutput{
+		outputUnit_c:  C.LBFGSB_NO_UNIT,
+		iterateUnit_c: C.LBFGSB_NO_UNIT,
+	}
+	if setup.printControl == 0 {
+		return output, nil
+	}
+	// Clean up on failure
+	defer func() {
+		if err != nil {
+			output.close()
+			output = nil
+		}
+	}()
+
+	// Standard output is collected too, to keep it from interleaving
+	writer := setup.output
+	if writer == nil {
+		writer = os.Stdout
+	}
+	output.outputUnit_c, err = output.open(writer)
+	if err != nil {
+		return
+	}
+	output.iterateUnit_c = output.outputUnit_c
+	if setup.printControl > 1 {
+		// The default file is written only after the run, like any
+		// other writer, so that concurrent runs do not open it
+		// together
+		writer = setup.iterateFile
+		if writer == nil {
+			writer = &iterateFile{path: iterateFileName, appending: resume}
+		}
+		output.iterateUnit_c, err = output.open(writer)
+	}
+	return
+}
+
+// open opens a unit that prints to the given writer.
+func (output *fortranOutput) open(writer io.Writer) (unit_c C.int, err error) {
+	// Choose the file for the unit
+	var path string
+	if writer == io.Discard {
+		path = os.DevNull
+	} else {
+		var pipe *fortranPipe
+		pipe, path, err = newFortranPipe(writer)
+		if err != nil {
+			return 0, err
+		}
+		output.pipes = append(output.pipes, pipe)
+	}
+
+	// Open the unit, never appending.  Pass the path as a
+	// null-terminated C string.
+	path_c := append([]byte(path), 0)
+	status_c := C.lbfgsb_open_output(
+		(*C.char)(unsafe.Pointer(&path_c[0])), C.int(0), &unit_c)
+	if ExitStatusCode(status_c) != SUCCESS {
+		return 0, fmt.Errorf("Lbfgsb: Could not open %s for Fortran output.", path)
+	}
+	output.units = append(output.units, unit_c)
+	return unit_c, nil
+}
+
+// close closes the units of this output (standard output is only
+// flushed) and writes the collected output to the writers.  Errors
+// writing are ignored.
+func (output *fortranOutput) close() {
+	// Close the units first so that the pipes end
+	for _, unit_c := range output.units {
+		C.lbfgsb_close_output(unit_c)
+	}
+	for _, pipe := range output.pipes {
+		pipe.collect()
+		pipe.collector.flush()
+	}
+}
+
+// iterateFile writes the summary of the iterations to a file.  The
+// first write replaces the file unless it is appending; later writes
+// append to it.  (The collected summary of a run is written under
+// fortranOutputLock, so the file is only ever open for one run.)
+type iterateFile struct {
+	path      string
+	appending bool
+}
+
+func (file *iterateFile) Write(data []byte) (int, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if file.appending {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(file.path, flags, 0666)
+	if err != nil {
+		return 0, err
+	}
+	file.appending = true
+	n, err := f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// outputCollector collects output for a writer so that the output of a
+// run is written in one piece when the run is done.  So that a long run
+// does not keep all its output in memory, once more than
+// maxCollectedOutput bytes have been collected, they are spilled to a
+// temporary file (or kept in memory if there is none).  Writing to the
+// writer is serialized by fortranOutputLock.
+type outputCollector struct {
+	writer io.Writer
+	buffer bytes.Buffer
+	// Temporary file of the output spilled so far, if any
+	spill       *os.File
+	spillFailed bool
+}
+
+// Write collects the given data, spilling what is collected if there is
+// too much.  Never fails.
+func (collector *outputCollector) Write(data []byte) (int, error) {
+	collector.buffer.Write(data)
+	if collector.buffer.Len() > maxCollectedOutput && !collector.spillFailed {
+		if collector.spill == nil {
+			spill, err := os.CreateTemp("", "lbfgsb-output-*")
+			if err != nil {
+				collector.spillFailed = true
+				return len(data), nil
+			}
+			collector.spill = spill
+		}
+		// Keep whatever could not be spilled in memory, and the rest
+		// too from then on, so that nothing is lost or reordered
+		n, err := collector.spill.Write(collector.buffer.Bytes())
+		collector.buffer.Next(n)
+		if err != nil {
+			collector.spillFailed = true
+		}
+	}
+	return len(data), nil
+}
+
+// flush writes out everything collected, first what was spilled and
+// then what is in memory, as one piece.
+func (collector *outputCollector) flush() {
+	fortranOutputLock.Lock()
+	defer fortranOutputLock.Unlock()
+	if spill := collector.spill; spill != nil {
+		if _, err := spill.Seek(0, io.SeekStart); err == nil {
+			io.Copy(collector.writer, spill)
+		}
+		spill.Close()
+		os.Remove(spill.Name())
+		collector.spill = nil
+	}
+	if collector.buffer.Len() > 0 {
+		collector.writer.Write(collector.buffer.Bytes())
+		collector.buffer.Reset()
+	}
+}
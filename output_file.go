@@ -0,0 +1,54 @@
+// Copyright (c) 2014 Aubrey Barnard.  This is free software.  See
+// LICENSE.txt for details.
+
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+// Collection of the Fortran output through temporary files, for
+// systems where the Fortran code cannot open a pipe by name.
+
+package lbfgsb
+
+import (
+	"io"
+	"os"
+)
+
+// fortranPipe collects what the Fortran code writes into a temporary
+// file for a writer (see outputCollector).
+type fortranPipe struct {
+	collector outputCollector
+	// Temporary file, which the Fortran code opens by name
+	path string
+}
+
+// newFortranPipe creates a temporary file that collects output for
+// the given writer and returns it along with the path by which the
+// Fortran code can open it.
+func newFortranPipe(writer io.Writer) (
+		pipe *fortranPipe, path string, err error) {
+
+	// Only the Fortran code has the file open while it runs
+	file, err := os.CreateTemp("", "lbfgsb-output-*")
+	if err != nil {
+		return nil, "", err
+	}
+	path = file.Name()
+	file.Close()
+	pipe = &fortranPipe{
+		collector: outputCollector{writer: writer},
+		path:      path,
+	}
+	return pipe, path, nil
+}
+
+// collect reads everything written to the file and deletes it.  The
+// Fortran unit must already be closed.
+func (pipe *fortranPipe) collect() {
+	file, err := os.Open(pipe.path)
+	if err == nil {
+		io.Copy(&pipe.collector, file)
+		file.Close()
+	}
+	os.Remove(pipe.path)
+}
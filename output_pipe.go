@@ -0,0 +1,57 @@
+// Copyright (c) 2014 Aubrey Barnard.  This is free software.  See
+// LICENSE.txt for details.
+
+//go:build linux || darwin
+// +build linux darwin
+
+// Collection of the Fortran output through pipes, which the Fortran
+// code opens by name through '/dev/fd'.
+
+package lbfgsb
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// fortranPipe collects what the Fortran code writes into a pipe for a
+// writer (see outputCollector).
+type fortranPipe struct {
+	collector outputCollector
+	// Write end of the pipe, which the Fortran code opens by name
+	file *os.File
+	done chan struct{}
+}
+
+// newFortranPipe creates a pipe that collects output for the given
+// writer and returns it along with the path by which the Fortran code
+// can open it.
+func newFortranPipe(writer io.Writer) (
+		pipe *fortranPipe, path string, err error) {
+
+	reader, file, err := os.Pipe()
+	if err != nil {
+		return nil, "", err
+	}
+	pipe = &fortranPipe{
+		collector: outputCollector{writer: writer},
+		file:      file,
+		done:      make(chan struct{}),
+	}
+	// Collect the output as it comes so that the Fortran code never
+	// blocks on a full pipe
+	go func() {
+		io.Copy(&pipe.collector, reader)
+		reader.Close()
+		close(pipe.done)
+	}()
+	return pipe, fmt.Sprintf("/dev/fd/%d", file.Fd()), nil
+}
+
+// collect ends the pipe and waits until everything written to it has
+// been collected.  The Fortran unit must already be closed.
+func (pipe *fortranPipe) collect() {
+	pipe.file.Close()
+	<-pipe.done
+}
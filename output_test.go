@@ -0,0 +1,148 @@
+// Copyright (c) 2014 Aubrey Barnard.  This is free software.  See
+// LICENSE.txt for details.
+
+// Tests of the routing of the Fortran output.
+
+package lbfgsb
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestFortranOutput checks that the output and the summary of the
+// iterations go to their writers at each print control.
+func TestFortranOutput(t *testing.T) {
+	const dim = 4
+	for _, printControl := range []int{0, 1, 2} {
+		var output, iterateFile bytes.Buffer
+		_, exitStatus := NewLbfgsb(dim).
+			SetFortranPrintControl(printControl).
+			SetFortranOutput(&output).
+			SetIterateFile(&iterateFile).
+			Minimize(shiftedSphere{}, make([]float64, dim))
+		if exitStatus.Code != SUCCESS {
+			t.Errorf("Print control %d: Minimization failed: %v",
+				printControl, exitStatus)
+			continue
+		}
+		// The output and the summary end with the final task
+		hasOutput := strings.Contains(output.String(), "CONVERGENCE")
+		hasSummary := strings.Contains(iterateFile.String(), "CONVERGENCE")
+		if hasOutput != (printControl >= 1) {
+			t.Errorf("Print control %d: Output %q.", printControl,
+				output.String())
+		}
+		if hasSummary != (printControl >= 2) {
+			t.Errorf("Print control %d: Summary of iterations %q.",
+				printControl, iterateFile.String())
+		}
+	}
+
+	// Output can be suppressed
+	_, exitStatus := NewLbfgsb(dim).
+		SetFortranPrintControl(2).
+		SetFortranOutput(nil).
+		SetIterateFile(nil).
+		Minimize(shiftedSphere{}, make([]float64, dim))
+	if exitStatus.Code != SUCCESS {
+		t.Errorf("Minimization with suppressed output failed: %v",
+			exitStatus)
+	}
+}
+
+// TestDefaultIterateFileConcurrent checks that concurrent minimizations
+// that write the summary of the iterations to the default file succeed
+// and leave the complete summary of one of them.
+func TestDefaultIterateFileConcurrent(t *testing.T) {
+	const dim = 4
+	const workers = 8
+	t.Chdir(t.TempDir())
+	solver := NewLbfgsb(dim).
+		SetFortranPrintControl(2).
+		SetFortranOutput(io.Discard)
+
+	var wait sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			minimum, exitStatus := solver.Minimize(
+				shiftedSphere{}, make([]float64, dim))
+			checkMinimum(t, minimum, exitStatus, 1e-4)
+		}()
+	}
+	wait.Wait()
+
+	summary, err := os.ReadFile(iterateFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := strings.Count(string(summary), "RUNNING THE L-BFGS-B CODE")
+	if runs != 1 || !strings.Contains(string(summary), "CONVERGENCE") {
+		t.Errorf("Summary of %d runs: %q.  Expected 1 complete run.",
+			runs, summary)
+	}
+}
+
+// chunkWriter records the chunks written to it.
+type chunkWriter struct {
+	chunks []string
+}
+
+func (writer *chunkWriter) Write(data []byte) (int, error) {
+	writer.chunks = append(writer.chunks, string(data))
+	return len(data), nil
+}
+
+// TestOutputCollector checks that a collector holds its output until it
+// is flushed, spilling it to a temporary file if there is too much, and
+// then writes it out in order.
+func TestOutputCollector(t *testing.T) {
+	writer := &chunkWriter{}
+	collector := outputCollector{writer: writer}
+	line := strings.Repeat("x", 999) + "\n"
+	// Write lines in two parts until the collector spills
+	var collected strings.Builder
+	for collector.spill == nil {
+		if collected.Len() > maxCollectedOutput {
+			t.Fatalf("Spilled nothing after collecting %d bytes.",
+				collected.Len())
+		}
+		collector.Write([]byte(line[:600]))
+		collector.Write([]byte(line[600:]))
+		collected.WriteString(line)
+	}
+	spillPath := collector.spill.Name()
+	// Collect some more, which is held in memory
+	for i := 0; i < 10; i++ {
+		collector.Write([]byte(line))
+		collected.WriteString(line)
+	}
+	if len(writer.chunks) != 0 {
+		t.Fatalf("Wrote %d chunks before flushing.  Expected 0.",
+			len(writer.chunks))
+	}
+	if collector.buffer.Len() > maxCollectedOutput {
+		t.Errorf("Held %d bytes in memory.  Expected <= %d.",
+			collector.buffer.Len(), maxCollectedOutput)
+	}
+
+	collector.flush()
+	collector.flush()
+	if strings.Join(writer.chunks, "") != collected.String() {
+		t.Errorf("Flushed %d bytes.  Expected the %d collected in order.",
+			len(strings.Join(writer.chunks, "")), collected.Len())
+	}
+	if collector.buffer.Len() != 0 || collector.spill != nil {
+		t.Errorf("Collector holds %d bytes after flushing.",
+			collector.buffer.Len())
+	}
+	if _, err := os.Stat(spillPath); !os.IsNotExist(err) {
+		t.Errorf("Spill file %s not removed: %v", spillPath, err)
+	}
+}
@@ -0,0 +1,463 @@
+// Copyright (c) 2014 Aubrey Barnard.  This is free software.  See
+// LICENSE.txt for details.
+
+// Step-wise (reverse-communication) optimization without callbacks.
+
+package lbfgsb
+
+// #include "lbfgsb_go_interface.h"
+import "C"
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// RequestKind is the kind of a request that a Session makes of its
+// caller.  Values match the C enum lbfgsb_request.
+type RequestKind uint8
+
+// Kinds of requests
+const (
+	// The optimization has terminated.  See Session.Result.
+	DONE RequestKind = iota
+	// Evaluate the objective function and gradient at the point and
+	// give them to Session.Provide.
+	EVALUATE
+	// The point is a new iterate.  Nothing needs to be done.
+	NEW_ITERATE
+)
+
+// String returns the name of this request kind.
+func (rk RequestKind) String() string {
+	switch rk {
+	case DONE:
+		return "DONE"
+	case EVALUATE:
+		return "EVALUATE"
+	case NEW_ITERATE:
+		return "NEW_ITERATE"
+	default:
+		return fmt.Sprintf("RequestKind(%d)", uint8(rk))
+	}
+}
+
+// Request is a request that a Session makes of its caller.
+type Request struct {
+	Kind RequestKind
+	// The point to evaluate, the new iterate, or the minimum.  Belongs
+	// to the caller.
+	X []float64
+	// Objective value and gradient at X for NEW_ITERATE and DONE
+	F float64
+	G []float64
+	// For NEW_ITERATE, the warning with which the line search that
+	// found X ended, if any (see Warning).  For the EVALUATE that
+	// starts a restart (see Lbfgsb.SetRestartPolicy),
+	// ABNORMAL_LINE_SEARCH.  Otherwise UNKNOWN_REASON.
+	Warning TerminationReason
+	// For NEW_ITERATE, the changes in the active set since the
+	// previous iterate (see OptimizationIterationInformation)
+	ActiveSetChanges []ActiveSetChange
+	// Numbers of iterations and evaluations done so far
+	Iteration   int
+	Evaluations int
+}
+
+// Session is a step-wise L-BFGS-B optimization that is driven by its
+// caller instead of by callbacks.  The caller repeatedly asks for the
+// next request with Next and does what is requested: for EVALUATE, it
+// evaluates the objective at the requested point and gives the value
+// and gradient to Provide; for NEW_ITERATE, it may log progress; for
+// DONE, it gets the result from Result.  Because no cgo callback frame
+// is held open while the caller works, evaluations can be done
+// asynchronously, remotely, or by the caller's own scheduler.
+//
+// The minimum and exit status are as for Lbfgsb.Minimize.  The
+// stopping criteria and limits of the solver apply, but its logger,
+// stop condition, warning handler, evaluation observer, and
+// checkpointing do not: the caller can do those between requests and
+// stop with Stop or Fail.  (Warnings are still listed in the exit
+// status.)  The Fortran output (see SetFortranOutput) is written when
+// the session is done; from its first step until then the session
+// holds its output open (if the print control is not 0), so a session
+// should be run until it is done or closed (see Close).  A session is
+// not safe for concurrent use.
+type Session struct {
+	// Solver, for statistics
+	lbfgsb *Lbfgsb
+	// Setup of the problem converted for C when the session was
+	// created.  The same values must be passed to every step.
+	dim_c               C.int
+	boundsControl_c     []C.int
+	lowerBounds_c       []C.double
+	upperBounds_c       []C.double
+	approximationSize_c C.int
+	fTolerance_c        C.double
+	gTolerance_c        C.double
+	maxIterations_c     C.int
+	maxEvaluations_c    C.int
+	maxRestarts_c       C.int
+	printControl_c      C.int
+	initialPoint        []float64
+	clamped             []int
+	// Line search parameters
+	lineSearchFTolerance_c     C.double
+	lineSearchGTolerance_c     C.double
+	lineSearchXTolerance_c     C.double
+	maxStep_c                  C.double
+	maxLineSearchEvaluations_c C.int
+	// Memory containing the whole state of the optimization
+	workspace *Workspace
+	// Setup of the output of the Fortran code and the output, which is
+	// opened by the first step (so that sessions that have not started,
+	// such as those of a batch, hold nothing open) and is open until
+	// the session is done
+	outputSetup fortranOutputSetup
+	output      *fortranOutput
+	// Active set of the previous iterate
+	activeSet *activeSetTracker
+
+	// Current request and whether the caller has answered it
+	request  Request
+	started  bool
+	answered bool
+	// Answer to an evaluation request and number of answers whose
+	// gradient was ignored because the value was not finite
+	f                float64
+	g                []float64
+	skippedGradients int
+	// When the first step was taken and the time spent in steps, for
+	// statistics
+	startTime  time.Time
+	solverTime time.Duration
+
+	// Result
+	minimum    PointValueGradient
+	exitStatus ExitStatus
+}
+
+// NewSession creates a session that minimizes an objective starting
+// from the given point with the setup (bounds, parameters, and
+// workspace) of this solver.  The setup is copied, so later changes to
+// this solver do not affect the session, but the workspace is not, so
+// it must not be used by anything else until the session is done.  If
+// the setup is invalid, the first request is DONE with a 'USAGE_ERROR'.
+func (lbfgsb *Lbfgsb) NewSession(initialPoint []float64) *Session {
+	return lbfgsb.newSession(initialPoint, false)
+}
+
+// newSession implements NewSession.  Gives the session a workspace of
+// its own (rather than the solver's) if asked.
+func (lbfgsb *Lbfgsb) newSession(
+	initialPoint []float64, ownWorkspace bool) *Session {
+
+	session := &Session{lbfgsb: lbfgsb}
+	projectedPoint, clamped, workspace, err :=
+		lbfgsb.prepare(initialPoint, nil, ownWorkspace)
+	if err != nil {
+		session.started = true
+		session.exitStatus.Code = USAGE_ERROR
+		session.exitStatus.Reason = INVALID_INPUT
+		session.exitStatus.Message = err.Error()
+		return session
+	}
+
+	dim := len(initialPoint)
+	session.dim_c = C.int(dim)
+	session.boundsControl_c = lbfgsb.boundsControl_c
+	session.lowerBounds_c = lbfgsb.lowerBounds_c
+	session.upperBounds_c = lbfgsb.upperBounds_c
+	session.approximationSize_c = C.int(lbfgsb.approximationSize)
+	session.fTolerance_c = C.double(lbfgsb.fTolerance)
+	session.gTolerance_c = C.double(lbfgsb.gTolerance)
+	session.maxIterations_c = C.int(lbfgsb.maxIterations)
+	session.maxEvaluations_c = C.int(lbfgsb.maxEvaluations)
+	session.maxRestarts_c = C.int(lbfgsb.maxRestarts)
+	session.lineSearchFTolerance_c = C.double(lbfgsb.lineSearchFTolerance)
+	session.lineSearchGTolerance_c = C.double(lbfgsb.lineSearchGTolerance)
+	session.lineSearchXTolerance_c = C.double(lbfgsb.lineSearchXTolerance)
+	session.maxStep_c = C.double(lbfgsb.maxStep)
+	session.maxLineSearchEvaluations_c =
+		C.int(lbfgsb.maxLineSearchEvaluations)
+	session.printControl_c = C.int(lbfgsb.printControl)
+	session.outputSetup = lbfgsb.fortranOutputSetup()
+	// Copy the point because the caller may change it
+	session.initialPoint = make([]float64, dim)
+	copy(session.initialPoint, projectedPoint)
+	session.clamped = clamped
+	session.activeSet = lbfgsb.newActiveSetTracker(session.initialPoint)
+	session.workspace = workspace
+	session.g = make([]float64, dim)
+	session.minimum.X = make([]float64, dim)
+	session.minimum.G = make([]float64, dim)
+	return session
+}
+
+// Next returns the current request if the caller has not answered it
+// yet (an EVALUATE request is answered by Provide) and otherwise
+// advances the optimization to the next request.  Once the
+// optimization is done, always returns DONE.
+func (session *Session) Next() Request {
+	if session.done() ||
+		(session.started && session.request.Kind == EVALUATE &&
+			!session.answered) {
+		return session.request
+	}
+	session.step(SUCCESS, "")
+	return session.request
+}
+
+// Provide gives the objective value and gradient at the point of the
+// current EVALUATE request.  The gradient is copied.  If the point is
+// outside the domain of the objective, provide a value of NaN: as in
+// Lbfgsb.Minimize, a value or gradient that is not finite makes the
+// line search try a shorter step.  Where the value is not finite, the
+// gradient is ignored and is not counted as a gradient evaluation in
+// the statistics.  Panics if the current request is not
+// an unanswered EVALUATE request or if the gradient has the wrong
+// dimensionality.
+func (session *Session) Provide(value float64, gradient []float64) {
+	if !session.started || session.request.Kind != EVALUATE ||
+		session.answered {
+		panic(fmt.Errorf("Lbfgsb: Provide called without an evaluation request."))
+	}
+	if len(gradient) != len(session.g) {
+		panic(fmt.Errorf("Lbfgsb: Dimensionality of the gradient (%d) does not match the dimensionality of the session (%d).", len(gradient), len(session.g)))
+	}
+	session.f = value
+	copy(session.g, gradient)
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		session.skippedGradients++
+	}
+	session.answered = true
+}
+
+// Stop stops the optimization early (without error).  The exit status
+// is a 'WARNING' whose message is the given reason.  Does nothing if
+// the optimization is already done.
+func (session *Session) Stop(reason string) {
+	if reason == "" {
+		reason = "Stopped by caller"
+	}
+	session.finish(WARNING, reason, nil)
+}
+
+// Fail stops the optimization because the objective could not be
+// evaluated.  The exit status is a 'FAILURE' that wraps the given
+// error.  Does nothing if the optimization is already done.
+func (session *Session) Fail(err error) {
+	session.finish(FAILURE,
+		fmt.Sprintf("Error: Objective evaluation failed: %v", err), err)
+}
+
+// Close ends the session, stopping the optimization as Stop does if it
+// is not done, and releases the Fortran output that the session holds
+// open (writing what has been printed).  The optimization being done
+// (including by Stop or Fail) also releases the output, so Close is
+// only needed when a session is abandoned, for example by deferring it
+// right after creating the session.  Calling it again does nothing.
+func (session *Session) Close() {
+	session.finish(WARNING, "Stopped: Session closed", nil)
+	session.closeOutput()
+}
+
+// Result returns the minimum and the exit status of the optimization.
+// Panics if the optimization is not done.
+func (session *Session) Result() (
+		minimum PointValueGradient,
+		exitStatus ExitStatus) {
+
+	if !session.done() {
+		panic(fmt.Errorf("Lbfgsb: Result called before the session is done."))
+	}
+	return session.minimum, session.exitStatus
+}
+
+// OptimizationStatistics returns some statistics about the
+// optimization once it is done: the total number of iterations and the
+// total numbers of function and gradient evaluations.  (These are also
+// in the exit status and are also saved as the solver's statistics.)
+func (session *Session) OptimizationStatistics() OptimizationStatistics {
+	return session.exitStatus.Statistics()
+}
+
+// closeOutput closes the Fortran output of this session if it is open.
+func (session *Session) closeOutput() {
+	if session.output != nil {
+		session.output.close()
+		session.output = nil
+	}
+}
+
+// done returns whether the optimization has terminated.
+func (session *Session) done() bool {
+	return session.started && session.request.Kind == DONE
+}
+
+// finish terminates the optimization with the given status, message,
+// and cause unless it is already done.
+func (session *Session) finish(
+	status ExitStatusCode, message string, cause error) {
+
+	// Start the optimization so that there is something to finish
+	if !session.started {
+		session.step(SUCCESS, "")
+	}
+	if session.done() {
+		return
+	}
+	session.step(status, message)
+	session.exitStatus.mutableDetails().cause = cause
+}
+
+// step does one step of the optimization, telling it the given status
+// of the caller (and the message if the status is not success), and
+// then records the request it makes.
+func (session *Session) step(status ExitStatusCode, message string) {
+	dim := int(session.dim_c)
+
+	// Open the Fortran output with the first step
+	if !session.started {
+		output, err := session.outputSetup.open(false)
+		if err != nil {
+			session.started = true
+			session.exitStatus.Code = FAILURE
+			session.exitStatus.Message =
+				fmt.Sprintf("Error: Fortran output failed: %v", err)
+			session.exitStatus.mutableDetails().cause = err
+			return
+		}
+		session.output = output
+	}
+
+	// Convert for C
+	var start_c C.int // false
+	if !session.started {
+		start_c = C.int(1) // true
+	}
+	var request_c, warning_c, minFallback_c, iters_c, evals_c C.int
+	var recoveries_c, reason_c C.int
+	var iterateF_c, iterateGNorm_c C.double
+	var skippedUpdates_c C.int
+	var minGNorm_c, cauchyTime_c, subspaceTime_c, lineSearchTime_c C.double
+	var finalMemorySize_c C.int
+	var finalTheta_c C.double
+	x := make([]float64, dim)
+	statusMessageLength_c := C.int(bufferSize)
+	var statusMessageBuffer [bufferSize]C.char
+	statusMessage_c := (*C.char)(&statusMessageBuffer[0])
+	if status != SUCCESS {
+		copyGoStringToC(message, statusMessage_c, statusMessageLength_c)
+	}
+
+	// Take the step
+	start := time.Now()
+	if !session.started {
+		session.startTime = start
+	}
+	statusCode_c := C.lbfgsb_step(
+		session.dim_c,
+		&session.boundsControl_c[0],
+		&session.lowerBounds_c[0], &session.upperBounds_c[0],
+		session.approximationSize_c,
+		session.fTolerance_c, session.gTolerance_c,
+		session.maxIterations_c, session.maxEvaluations_c,
+		session.maxRestarts_c,
+		session.lineSearchFTolerance_c, session.lineSearchGTolerance_c,
+		session.lineSearchXTolerance_c, session.maxStep_c,
+		session.maxLineSearchEvaluations_c,
+		(*C.double)(&session.initialPoint[0]),
+		0, nil, nil, 1.0,
+		&session.workspace.realMemory[0],
+		&session.workspace.intMemory[0],
+		&session.workspace.charMemory[0],
+		start_c,
+		C.int(status), C.double(session.f), (*C.double)(&session.g[0]),
+		&request_c, (*C.double)(&x[0]), &warning_c,
+		&iterateF_c, &iterateGNorm_c,
+		(*C.double)(&session.minimum.X[0]),
+		(*C.double)(&session.minimum.F),
+		(*C.double)(&session.minimum.G[0]),
+		&minFallback_c, &iters_c, &evals_c, &recoveries_c, &reason_c,
+		&minGNorm_c, &skippedUpdates_c,
+		&cauchyTime_c, &subspaceTime_c, &lineSearchTime_c,
+		&finalMemorySize_c, nil, nil, &finalTheta_c,
+		session.printControl_c,
+		session.output.outputUnit_c, session.output.iterateUnit_c,
+		statusMessage_c, statusMessageLength_c,
+	)
+	session.solverTime += time.Since(start)
+	session.started = true
+	session.answered = false
+
+	// Record the request.  Requests match between RequestKind and the C
+	// enum.
+	session.request = Request{
+		Kind:        RequestKind(request_c),
+		X:           x,
+		Iteration:   int(iters_c),
+		Evaluations: int(evals_c),
+	}
+	// Warnings match the termination reasons
+	session.request.Warning = TerminationReason(warning_c)
+	if session.request.Warning != UNKNOWN_REASON {
+		details := session.exitStatus.mutableDetails()
+		details.warnings = append(details.warnings,
+			Warning{Iteration: int(iters_c), Reason: session.request.Warning})
+		if session.request.Warning == ABNORMAL_LINE_SEARCH {
+			statistics := &details.statistics
+			statistics.RestartHistory = append(statistics.RestartHistory,
+				RestartStatistics{
+					Iteration:   int(iters_c),
+					Evaluations: int(evals_c),
+					F:           float64(iterateF_c),
+					GNorm:       float64(iterateGNorm_c),
+				})
+		}
+	}
+	switch session.request.Kind {
+	case NEW_ITERATE:
+		// The new iterate is the point evaluated most recently
+		session.request.F = session.f
+		session.request.G = make([]float64, dim)
+		copy(session.request.G, session.g)
+		session.request.ActiveSetChanges = session.activeSet.update(x)
+	case DONE:
+		session.closeOutput()
+		session.request.F = session.minimum.F
+		session.request.G = make([]float64, dim)
+		copy(session.request.G, session.minimum.G)
+
+		// Convert outputs as in minimize
+		session.exitStatus.Code = ExitStatusCode(statusCode_c)
+		session.exitStatus.Reason = TerminationReason(reason_c)
+		session.exitStatus.Message = C.GoString(statusMessage_c)
+		session.exitStatus.Fallback = minFallback_c != 0
+
+		// Save statistics
+		statistics := &session.exitStatus.mutableDetails().statistics
+		statistics.ClampedCoordinates = session.clamped
+		statistics.Iterations = int(iters_c)
+		statistics.FunctionEvaluations = int(evals_c)
+		statistics.GradientEvaluations =
+			int(evals_c) - session.skippedGradients
+		statistics.DomainRecoveries = int(recoveries_c)
+		statistics.Restarts = len(statistics.RestartHistory)
+		statistics.SkippedUpdates = int(skippedUpdates_c)
+		statistics.FinalGNorm = float64(minGNorm_c)
+		statistics.FinalActiveVariables =
+			session.activeSet.size(session.minimum.X)
+		statistics.CauchyTime = secondsToDuration(float64(cauchyTime_c))
+		statistics.SubspaceTime =
+			secondsToDuration(float64(subspaceTime_c))
+		statistics.LineSearchTime =
+			secondsToDuration(float64(lineSearchTime_c))
+		// The caller works between the steps
+		statistics.WallTime = time.Since(session.startTime)
+		statistics.SolverTime = session.solverTime
+		statistics.CallbackTime = statistics.WallTime - statistics.SolverTime
+		session.lbfgsb.saveStatistics(*statistics)
+	}
+}
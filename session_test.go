@@ -0,0 +1,236 @@
+// Copyright (c) 2014 Aubrey Barnard.  This is free software.  See
+// LICENSE.txt for details.
+
+// Tests of step-wise optimization.
+
+package lbfgsb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// TestSession minimizes by driving a session instead of by callbacks.
+func TestSession(t *testing.T) {
+	const dim = 6
+	objective := shiftedSphere{}
+	session := NewLbfgsb(dim).NewSession(make([]float64, dim))
+	var iterations int
+	for request := session.Next(); request.Kind != DONE; request = session.Next() {
+		switch request.Kind {
+		case EVALUATE:
+			session.Provide(objective.EvaluateFunction(request.X),
+				objective.EvaluateGradient(request.X))
+		case NEW_ITERATE:
+			iterations++
+		}
+	}
+	minimum, exitStatus := session.Result()
+	checkMinimum(t, minimum, exitStatus, 1e-4)
+	if iterations != exitStatus.Statistics().Iterations {
+		t.Errorf("Saw %d iterations.  Expected %d.",
+			iterations, exitStatus.Statistics().Iterations)
+	}
+}
+
+// TestSessionClose abandons a session part way and checks that closing
+// it ends it and writes its Fortran output.
+func TestSessionClose(t *testing.T) {
+	var output bytes.Buffer
+	session := NewLbfgsb(2).
+		SetFortranPrintControl(1).
+		SetFortranOutput(&output).
+		NewSession([]float64{5, 5})
+	for i := 0; i < 3; i++ {
+		request := session.Next()
+		if request.Kind == EVALUATE {
+			session.Provide(shiftedSphere{}.EvaluateFunction(request.X),
+				shiftedSphere{}.EvaluateGradient(request.X))
+		}
+	}
+	session.Close()
+	session.Close()
+	if request := session.Next(); request.Kind != DONE {
+		t.Errorf("Request %v after Close.  Expected %v.",
+			request.Kind, DONE)
+	}
+	if _, exitStatus := session.Result(); exitStatus.Code != WARNING {
+		t.Errorf("Exit status %v.  Expected %v.", exitStatus.Code, WARNING)
+	}
+	if output.Len() == 0 {
+		t.Errorf("Fortran output not written when closed")
+	}
+}
+
+// TestSessionFail checks that failing a session fails the optimization
+// with the given error.
+func TestSessionFail(t *testing.T) {
+	session := NewLbfgsb(2).NewSession([]float64{5, 5})
+	defer session.Close()
+	if request := session.Next(); request.Kind != EVALUATE {
+		t.Fatalf("Request %v.  Expected %v.", request.Kind, EVALUATE)
+	}
+	cause := errors.New("no evaluation")
+	session.Fail(cause)
+	_, exitStatus := session.Result()
+	if exitStatus.Code != FAILURE {
+		t.Errorf("Exit status %v.  Expected %v.", exitStatus.Code, FAILURE)
+	}
+	if !errors.Is(exitStatus, cause) {
+		t.Errorf("Exit status %v does not wrap %v.", exitStatus, cause)
+	}
+}
+
+// TestSessionProvideWrongDimensionality checks that providing a
+// gradient of the wrong dimensionality panics.
+func TestSessionProvideWrongDimensionality(t *testing.T) {
+	session := NewLbfgsb(2).NewSession([]float64{5, 5})
+	defer session.Close()
+	session.Next()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Provide accepted a gradient of the wrong " +
+				"dimensionality")
+		}
+	}()
+	session.Provide(1, []float64{1, 2, 3})
+}
+
+// sphereBatch evaluates the shifted sphere at many points at once.
+type sphereBatch struct{}
+
+func (sphereBatch) EvaluateBatch(points [][]float64) (
+	values []float64, gradients [][]float64) {
+
+	for _, point := range points {
+		values = append(values, shiftedSphere{}.EvaluateFunction(point))
+		gradients = append(gradients,
+			shiftedSphere{}.EvaluateGradient(point))
+	}
+	return
+}
+
+// TestBatch minimizes several problems in lockstep and checks that
+// the results are those of minimizing each problem by itself.
+func TestBatch(t *testing.T) {
+	const dim = 4
+	initialPoints := [][]float64{
+		{0, 0, 0, 0}, {10, -10, 10, -10}, {-3, 1, 4, 1}}
+	minima, exitStatuses := NewBatchLbfgsb(NewLbfgsb(dim)).Minimize(
+		sphereBatch{}, initialPoints)
+	for i, initialPoint := range initialPoints {
+		checkMinimum(t, minima[i], exitStatuses[i], 1e-4)
+		minimum, exitStatus := NewLbfgsb(dim).Minimize(
+			shiftedSphere{}, initialPoint)
+		if minima[i].F != minimum.F {
+			t.Errorf("Problem %d: Minimum %g.  Expected %g.",
+				i, minima[i].F, minimum.F)
+		}
+		for j := range minimum.X {
+			if minima[i].X[j] != minimum.X[j] {
+				t.Errorf("Problem %d: Minimum at %v.  Expected %v.",
+					i, minima[i].X, minimum.X)
+				break
+			}
+		}
+		batchStatistics := exitStatuses[i].Statistics()
+		statistics := exitStatus.Statistics()
+		if batchStatistics.Iterations != statistics.Iterations ||
+			batchStatistics.FunctionEvaluations !=
+				statistics.FunctionEvaluations {
+			t.Errorf("Problem %d: %d iterations and %d evaluations.  "+
+				"Expected %d and %d.", i,
+				batchStatistics.Iterations,
+				batchStatistics.FunctionEvaluations,
+				statistics.Iterations, statistics.FunctionEvaluations)
+		}
+	}
+}
+
+// badBatch returns one value and gradient too few or, if asked, a
+// gradient of the wrong dimensionality for the first point of the
+// first call, or panics.
+type badBatch struct {
+	wrongDimensionality bool
+	panics              bool
+	calls               int
+}
+
+func (batch *badBatch) EvaluateBatch(points [][]float64) (
+	values []float64, gradients [][]float64) {
+
+	batch.calls++
+	if batch.panics {
+		panic("batch")
+	}
+	values, gradients = sphereBatch{}.EvaluateBatch(points)
+	if batch.wrongDimensionality {
+		if batch.calls == 1 {
+			gradients[0] = gradients[0][1:]
+		}
+		return
+	}
+	return values[1:], gradients[1:]
+}
+
+// TestBatchMismatchedResults checks that the problems whose results
+// are missing or malformed fail.
+func TestBatchMismatchedResults(t *testing.T) {
+	initialPoints := [][]float64{{1, 1}, {2, 2}}
+	batch := NewBatchLbfgsb(NewLbfgsb(2))
+
+	// Wrong numbers of results fail all the problems
+	_, exitStatuses := batch.Minimize(&badBatch{}, initialPoints)
+	for i, exitStatus := range exitStatuses {
+		if exitStatus.Code != FAILURE {
+			t.Errorf("Problem %d: Exit status %v.  Expected %v.",
+				i, exitStatus.Code, FAILURE)
+		}
+	}
+
+	// A gradient of the wrong dimensionality fails only its problem
+	minima, exitStatuses := batch.Minimize(
+		&badBatch{wrongDimensionality: true}, initialPoints)
+	if exitStatuses[0].Code != FAILURE {
+		t.Errorf("Problem 0: Exit status %v.  Expected %v.",
+			exitStatuses[0].Code, FAILURE)
+	}
+	checkMinimum(t, minima[1], exitStatuses[1], 1e-4)
+}
+
+// TestBatchPanic checks that a panic in the objective closes the
+// problems and is raised again as a *CallbackPanic.
+func TestBatchPanic(t *testing.T) {
+	var output bytes.Buffer
+	solver := NewLbfgsb(2).
+		SetFortranPrintControl(1).
+		SetFortranOutput(&output)
+	defer func() {
+		value := recover()
+		if callbackPanic, ok := value.(*CallbackPanic); !ok ||
+			callbackPanic.Value != "batch" {
+			t.Errorf("Recovered %v.  Expected a *CallbackPanic.", value)
+		}
+		if output.Len() == 0 {
+			t.Errorf("Fortran output not written when closed")
+		}
+	}()
+	NewBatchLbfgsb(solver).Minimize(
+		&badBatch{panics: true}, [][]float64{{1, 1}, {2, 2}})
+}
+
+// TestBatchManyProblems minimizes more problems than the usual limit on
+// open files (1024) to check that the problems do not hold any open.
+func TestBatchManyProblems(t *testing.T) {
+	const problems = 4096
+	initialPoints := make([][]float64, problems)
+	for i := range initialPoints {
+		initialPoints[i] = []float64{float64(i % 7), -float64(i % 5)}
+	}
+	minima, exitStatuses := NewBatchLbfgsb(NewLbfgsb(2)).Minimize(
+		sphereBatch{}, initialPoints)
+	for i := range initialPoints {
+		checkMinimum(t, minima[i], exitStatuses[i], 1e-4)
+	}
+}